@@ -0,0 +1,109 @@
+package pnglevel
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// APNG frames are stored in fdAT chunks, each holding a sequence
+// number followed by a part of the frame's zlib stream, similar to
+// IDAT. Consecutive fdAT chunks of a frame are collected, and their
+// stream is recompressed and split again when the frame ends.
+// Since the number of chunks may change, sequence numbers of fcTL
+// and fdAT chunks are rewritten. A frame that doesn't get smaller is
+// written as it was, in chunks of the original lengths unless
+// IDATSize is set.
+
+// apng reports whether animation frames are recompressed.
+func (p *Reader) apng() bool {
+	return !p.opts.StripAnimation && !p.verbatim["fcTL"] && !p.verbatim["fdAT"]
+}
+
+// animationChunks are removed by StripAnimation.
+var animationChunks = map[string]bool{
+	"acTL": true,
+	"fcTL": true,
+	"fdAT": true,
+}
+
+// renumber returns fcTL chunk data and checksum with the next sequence number.
+func (p *Reader) renumber(data []byte, crc uint32) ([]byte, uint32, error) {
+	if len(data) != 26 {
+		return nil, 0, errors.New("pnglevel: invalid fcTL chunk")
+	}
+	if binary.BigEndian.Uint32(data) != p.seq {
+		binary.BigEndian.PutUint32(data, p.seq)
+		crc = chunkCRC(p.crcTable(), "fcTL", data)
+	}
+	p.seq++
+	return data, crc, nil
+}
+
+// addFrameData adds fdAT chunk data to the current frame.
+func (p *Reader) addFrameData(data []byte) error {
+	if len(data) < 4 {
+		return errors.New("pnglevel: invalid fdAT chunk")
+	}
+	p.frame = append(p.frame, data[4:]...)
+	p.frameLayout = append(p.frameLayout, len(data)-4)
+	p.inFrame = true
+	return nil
+}
+
+// writeFrame writes recompressed data of the current frame, if any,
+// as fdAT chunks, or its original data if that is not larger.
+func (p *Reader) writeFrame() error {
+	if !p.inFrame {
+		return nil
+	}
+	z, err := p.recompress(p.frame)
+	if err != nil {
+		return err
+	}
+	size := bufSize
+	if p.opts.IDATSize > 0 {
+		// Include the sequence number.
+		size = p.opts.IDATSize - 4
+	}
+	layout, orig := splitLengths(len(z), size), p.frameLayout
+	if p.opts.IDATSize > 0 {
+		orig = splitLengths(len(p.frame), size)
+	}
+	if framedSize(z, layout) >= framedSize(p.frame, orig) {
+		z, layout = p.frame, orig
+	}
+	longest := 0
+	for _, n := range layout {
+		if n > longest {
+			longest = n
+		}
+	}
+	data := make([]byte, 4+longest)
+	for _, n := range layout {
+		binary.BigEndian.PutUint32(data, p.seq)
+		copy(data[4:], z[:n])
+		p.writeChunk("fdAT", data[:4+n], chunkCRC(p.crcTable(), "fdAT", data[:4+n]))
+		p.seq++
+		z = z[n:]
+	}
+	p.frame = p.frame[:0]
+	p.frameLayout = p.frameLayout[:0]
+	p.inFrame = false
+	return nil
+}
+
+// splitLengths returns the lengths of chunks of at most size bytes
+// holding n bytes.
+func splitLengths(n, size int) []int {
+	var lengths []int
+	for ; n > 0; n -= size {
+		lengths = append(lengths, min(n, size))
+	}
+	return lengths
+}
+
+// framedSize returns the size of fdAT chunks holding frame data z
+// split into chunks of the given lengths.
+func framedSize(z []byte, layout []int) int {
+	return len(z) + len(layout)*(12+4)
+}
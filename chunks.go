@@ -0,0 +1,532 @@
+package pnglevel
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"sort"
+)
+
+// Chunk is a PNG chunk.
+type Chunk struct {
+	Type string
+	Data []byte
+}
+
+// rawChunk is a complete chunk held in memory.
+type rawChunk struct {
+	kind string
+	data []byte
+	crc  uint32
+}
+
+// newChunk returns a chunk with the given data and its checksum
+// computed with tab.
+func newChunk(kind string, data []byte, tab *crc32.Table) rawChunk {
+	c := rawChunk{kind: kind}
+	c.set(data, tab)
+	return c
+}
+
+// set replaces chunk data, updating its checksum.
+func (c *rawChunk) set(data []byte, tab *crc32.Table) {
+	c.data = data
+	c.crc = chunkCRC(tab, c.kind, data)
+}
+
+// crcTable returns the table used for chunk checksums.
+func (p *Reader) crcTable() *crc32.Table {
+	if p.opts.CRCTable != nil {
+		return p.opts.CRCTable
+	}
+	return crc32.IEEETable
+}
+
+func findChunk(chunks []rawChunk, kind string) *rawChunk {
+	for i := range chunks {
+		if chunks[i].kind == kind {
+			return &chunks[i]
+		}
+	}
+	return nil
+}
+
+// heldChunks removes the held output, which consists of the PNG
+// signature followed by complete chunks, and returns its chunks.
+func (p *Reader) heldChunks() []rawChunk {
+	chunks := parseChunks(p.w.Bytes()[len(pngHeader):])
+	p.w.Reset()
+	return chunks
+}
+
+// parseChunks returns copies of the complete chunks in b.
+func parseChunks(b []byte) []rawChunk {
+	b = append([]byte(nil), b...)
+	var chunks []rawChunk
+	for len(b) > 0 {
+		n := binary.BigEndian.Uint32(b[0:4])
+		chunks = append(chunks, rawChunk{
+			kind: string(b[4:8]),
+			data: b[8 : 8+n],
+			crc:  binary.BigEndian.Uint32(b[8+n:]),
+		})
+		b = b[12+n:]
+	}
+	return chunks
+}
+
+// writeChunk writes a complete chunk to the output.
+func (p *Reader) writeChunk(kind string, data []byte, crc uint32) {
+	var b [8]byte
+	binary.BigEndian.PutUint32(b[:4], uint32(len(data)))
+	copy(b[4:], kind)
+	p.w.Write(b[:])
+	p.w.Write(data)
+	binary.BigEndian.PutUint32(b[:4], crc)
+	p.w.Write(b[:4])
+}
+
+// sinkChunks passes complete chunks from the output to ChunkSink,
+// counting them as returned.
+func (p *Reader) sinkChunks() error {
+	if p.opts.ChunkSink == nil {
+		return nil
+	}
+	if p.start == stStart && !p.sentSig {
+		if p.w.Len() < len(pngHeader) {
+			return nil
+		}
+		p.w.Next(len(pngHeader))
+		p.out += int64(len(pngHeader))
+		p.sentSig = true
+	}
+	for {
+		b := p.w.Bytes()
+		if len(b) < 8 {
+			return nil
+		}
+		n := int(binary.BigEndian.Uint32(b[:4]))
+		if len(b) < 12+n {
+			return nil
+		}
+		if err := p.opts.ChunkSink(string(b[4:8]), b[8:8+n], binary.BigEndian.Uint32(b[8+n:])); err != nil {
+			return err
+		}
+		p.w.Next(12 + n)
+		p.out += int64(12 + n)
+	}
+}
+
+// chunkCRC computes the checksum of a chunk using tab. The type is
+// hashed with the table directly rather than converted to a slice,
+// which would escape to the heap on every call.
+func chunkCRC(tab *crc32.Table, kind string, data []byte) uint32 {
+	crc := ^uint32(0)
+	for i := 0; i < len(kind); i++ {
+		crc = tab[byte(crc)^kind[i]] ^ crc>>8
+	}
+	return crc32.Update(^crc, tab, data)
+}
+
+// whole reports whether chunks of the given type are read into memory
+// as a whole to be processed by handleWholeChunk.
+func (p *Reader) whole(kind string) bool {
+	switch kind {
+	case "eXIf":
+		return p.opts.StripEXIF || p.opts.OnEXIFThumbnail != nil
+	case "sCAL":
+		return p.opts.ValidateSCAL
+	case "zTXt", "iTXt", "iCCP":
+		return !p.verbatim[kind]
+	case "tEXt":
+		if p.opts.CompressText && !p.verbatim[kind] {
+			return true
+		}
+	case "fcTL", "fdAT":
+		return p.apng()
+	}
+	return p.opts.Dedup && p.dedupable(kind)
+}
+
+// drop reports whether chunks of the given type are removed
+// from the output according to KeepChunk or StripAnimation.
+func (p *Reader) drop(kind string) bool {
+	if isCritical(kind) || p.verbatim[kind] {
+		return false
+	}
+	if p.opts.StripAnimation && animationChunks[kind] {
+		return true
+	}
+	if p.opts.SetDPI > 0 && kind == "pHYs" {
+		return true
+	}
+	return p.opts.KeepChunk != nil && !p.opts.KeepChunk(kind)
+}
+
+// dedupable reports whether chunks of the given type
+// are checked for duplicates with Dedup.
+func (p *Reader) dedupable(kind string) bool {
+	return !isCritical(kind) && !animationChunks[kind] && !p.verbatim[kind]
+}
+
+// duplicate reports whether the chunk is removed by Dedup
+// as a copy of an earlier one, remembering it otherwise.
+func (p *Reader) duplicate(kind string, data []byte) bool {
+	if !p.opts.Dedup || !p.dedupable(kind) {
+		return false
+	}
+	h := sha256.New()
+	h.Write([]byte(kind))
+	h.Write(data)
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	if p.seen[sum] {
+		return true
+	}
+	if p.seen == nil {
+		p.seen = make(map[[sha256.Size]byte]bool)
+	}
+	p.seen[sum] = true
+	return false
+}
+
+// handleWholeChunk reads the current chunk into memory,
+// processes it, and writes the result, if any.
+func (p *Reader) handleWholeChunk() error {
+	data, crc, err := p.readChunk()
+	if err != nil {
+		return err
+	}
+	p.stage = stChunkHead
+	p.chunkDone(p.chunkType, len(data))
+	switch p.chunkType {
+	case "eXIf":
+		if p.opts.OnEXIFThumbnail != nil {
+			if thumb := exifThumbnail(data); thumb != nil {
+				p.opts.OnEXIFThumbnail(thumb)
+			}
+		}
+		if p.opts.StripEXIF && !p.verbatim["eXIf"] {
+			return nil
+		}
+	case "sCAL":
+		if !validSCAL(data) {
+			return errors.New("pnglevel: invalid sCAL chunk")
+		}
+	}
+	if p.skip || p.duplicate(p.chunkType, data) {
+		return nil
+	}
+	if p.recomputeCRC() {
+		crc = p.crc.Sum32()
+	}
+	kind := p.chunkType
+	switch kind {
+	case "tEXt":
+		if !p.opts.CompressText {
+			break
+		}
+		z, err := p.compressText(data)
+		if err != nil {
+			return err
+		}
+		if z != nil {
+			kind = "zTXt"
+			data, crc = z, chunkCRC(p.crcTable(), kind, z)
+		}
+	case "zTXt", "iTXt", "iCCP":
+		z, err := p.recompressChunk(p.chunkType, data)
+		if err != nil {
+			return err
+		}
+		// With KeepSmaller, keep the original unless it is larger.
+		if !bytes.Equal(z, data) && (!p.opts.KeepSmaller || len(z) < len(data)) {
+			data, crc = z, chunkCRC(p.crcTable(), p.chunkType, z)
+		}
+	case "fcTL":
+		if data, crc, err = p.renumber(data, crc); err != nil {
+			return err
+		}
+	case "fdAT":
+		return p.addFrameData(data)
+	}
+	p.writeChunk(kind, data, crc)
+	return nil
+}
+
+// readChunk reads the rest of the current chunk and verifies its
+// checksum, which it returns along with chunk data.
+func (p *Reader) readChunk() (data []byte, crc uint32, err error) {
+	// Let the buffer grow as data arrives rather than trusting the length.
+	data, err = io.ReadAll(io.LimitReader(p.r, int64(p.chunkLen)))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(data) < p.chunkLen {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	p.crc.Write(data)
+	p.retain(data)
+	p.chunkLen = 0
+	if _, err := io.ReadFull(p.r, p.tmp[:4]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	crc = binary.BigEndian.Uint32(p.tmp[:4])
+	if err := p.checkCrc(crc); err != nil {
+		return nil, 0, err
+	}
+	return data, crc, nil
+}
+
+// writeHeld writes the signature and held chunks, ending holding.
+// With Canonicalize, holding continues until IEND.
+func (p *Reader) writeHeld(chunks []rawChunk) error {
+	if p.opts.Canonicalize {
+		if p.sawIEND {
+			chunks = p.canonicalOrder(append(chunks, p.trailer...))
+			p.trailer = nil
+		} else {
+			p.w.WriteString(pngHeader)
+			for _, c := range chunks {
+				p.writeChunk(c.kind, c.data, c.crc)
+			}
+			return nil
+		}
+	}
+	if p.opts.OrderFunc != nil {
+		var err error
+		if chunks, err = p.order(chunks); err != nil {
+			return err
+		}
+	}
+	if p.opts.IDATFirst {
+		// Move everything but IHDR to the trailer.
+		for _, c := range chunks[1:] {
+			if beforeIDAT[c.kind] {
+				return fmt.Errorf("pnglevel: %s chunk cannot follow IDAT", c.kind)
+			}
+		}
+		p.trailer = append(chunks[1:len(chunks):len(chunks)], p.trailer...)
+		chunks = chunks[:1]
+	}
+	p.w.WriteString(pngHeader)
+	for _, c := range chunks {
+		p.writeChunk(c.kind, c.data, c.crc)
+	}
+	p.hold = false
+	return nil
+}
+
+// beforeIDAT contains types of chunks that must precede image data.
+var beforeIDAT = map[string]bool{
+	"PLTE": true,
+	"acTL": true,
+	"bKGD": true,
+	"cHRM": true,
+	"cICP": true,
+	"cLLI": true,
+	"eXIf": true,
+	"gAMA": true,
+	"hIST": true,
+	"iCCP": true,
+	"mDCV": true,
+	"oFFs": true,
+	"pCAL": true,
+	"pHYs": true,
+	"sBIT": true,
+	"sCAL": true,
+	"sPLT": true,
+	"sRGB": true,
+	"tRNS": true,
+}
+
+// prePLTE contains types of chunks that must precede PLTE.
+var prePLTE = map[string]bool{
+	"cHRM": true,
+	"cICP": true,
+	"cLLI": true,
+	"gAMA": true,
+	"iCCP": true,
+	"mDCV": true,
+	"sBIT": true,
+	"sRGB": true,
+}
+
+// canonicalOrder sorts chunks for Canonicalize.
+func (p *Reader) canonicalOrder(chunks []rawChunk) []rawChunk {
+	type rankedChunk struct {
+		rawChunk
+		rank int
+	}
+	ranked := make([]rankedChunk, len(chunks))
+	prev := 0
+	for i, c := range chunks {
+		r := prev
+		switch {
+		case c.kind == "IHDR":
+			r = 0
+		case c.kind == "PLTE":
+			r = 2
+		case c.kind == "IDAT" || c.kind == "fcTL" || c.kind == "fdAT":
+			r = 4
+		case isCritical(c.kind) || p.verbatim[c.kind]:
+			// Keep position relative to the preceding chunk.
+		case prePLTE[c.kind]:
+			r = 1
+		case beforeIDAT[c.kind]:
+			r = 3
+		default:
+			r = 5
+		}
+		ranked[i] = rankedChunk{c, r}
+		prev = r
+	}
+	sort.SliceStable(ranked, func(i, j int) bool { return ranked[i].rank < ranked[j].rank })
+	for i := range ranked {
+		chunks[i] = ranked[i].rawChunk
+	}
+	return chunks
+}
+
+// order passes ancillary chunks to OrderFunc, returning chunks to
+// write before image data and saving the rest for the trailer.
+func (p *Reader) order(chunks []rawChunk) ([]rawChunk, error) {
+	var keep []rawChunk
+	var anc []Chunk
+	for _, c := range chunks {
+		if isCritical(c.kind) || p.verbatim[c.kind] {
+			keep = append(keep, c)
+			continue
+		}
+		anc = append(anc, Chunk{Type: c.kind, Data: c.data})
+	}
+	before, after := p.opts.OrderFunc(anc)
+	// Chunks that must precede PLTE are written before it.
+	plte := len(keep)
+	for i, c := range keep {
+		if c.kind == "PLTE" {
+			plte = i
+		}
+	}
+	var pre, post []rawChunk
+	for _, c := range before {
+		if !isAncillaryType(c.Type) {
+			return nil, errors.New("pnglevel: OrderFunc returned invalid chunk type")
+		}
+		if prePLTE[c.Type] && plte < len(keep) {
+			pre = append(pre, newChunk(c.Type, c.Data, p.crcTable()))
+		} else {
+			post = append(post, newChunk(c.Type, c.Data, p.crcTable()))
+		}
+	}
+	for _, c := range after {
+		if !isAncillaryType(c.Type) {
+			return nil, errors.New("pnglevel: OrderFunc returned invalid chunk type")
+		}
+		if beforeIDAT[c.Type] {
+			return nil, fmt.Errorf("pnglevel: OrderFunc placed %s chunk after image data", c.Type)
+		}
+		p.trailer = append(p.trailer, newChunk(c.Type, c.Data, p.crcTable()))
+	}
+	out := append(keep[:plte:plte], pre...)
+	out = append(out, keep[plte:]...)
+	return append(out, post...), nil
+}
+
+// writeInserts writes inserted chunks that precede image data.
+func (p *Reader) writeInserts() {
+	for _, c := range p.inserts {
+		p.writeChunk(c.kind, c.data, c.crc)
+	}
+	p.inserts = nil
+}
+
+// writeTrailer writes chunks saved for the end of file.
+func (p *Reader) writeTrailer() {
+	for _, c := range p.trailer {
+		p.writeChunk(c.kind, c.data, c.crc)
+	}
+	p.trailer = nil
+}
+
+// physData returns pHYs chunk data for the resolution in pixels per inch.
+func physData(dpi float64) []byte {
+	ppm := uint32(math.Round(dpi / 0.0254))
+	b := make([]byte, 9)
+	binary.BigEndian.PutUint32(b[0:4], ppm)
+	binary.BigEndian.PutUint32(b[4:8], ppm)
+	b[8] = 1 // meter
+	return b
+}
+
+// isAncillaryType reports whether kind is a well-formed
+// ancillary chunk type.
+func isAncillaryType(kind string) bool {
+	if len(kind) != 4 {
+		return false
+	}
+	for i := 0; i < 4; i++ {
+		c := kind[i] | 0x20
+		if c < 'a' || c > 'z' {
+			return false
+		}
+	}
+	return !isCritical(kind)
+}
+
+// validSCAL reports whether data is a well-formed sCAL chunk.
+func validSCAL(data []byte) bool {
+	if len(data) < 4 || (data[0] != 1 && data[0] != 2) {
+		return false
+	}
+	i := bytes.IndexByte(data[1:], 0)
+	if i < 0 {
+		return false
+	}
+	return validSCALValue(data[1:1+i]) && validSCALValue(data[2+i:])
+}
+
+// validSCALValue reports whether b is a positive floating-point number
+// in the format allowed by sCAL: digits with an optional leading plus
+// sign, decimal point, and exponent.
+func validSCALValue(b []byte) bool {
+	if len(b) > 0 && b[0] == '+' {
+		b = b[1:]
+	}
+	digits := func() (n int, nonzero bool) {
+		for n < len(b) && b[n] >= '0' && b[n] <= '9' {
+			nonzero = nonzero || b[n] != '0'
+			n++
+		}
+		b = b[n:]
+		return
+	}
+	n, nz := digits()
+	if len(b) > 0 && b[0] == '.' {
+		b = b[1:]
+		m, mz := digits()
+		n += m
+		nz = nz || mz
+	}
+	if n == 0 || !nz {
+		return false
+	}
+	if len(b) > 0 && (b[0] == 'e' || b[0] == 'E') {
+		b = b[1:]
+		if len(b) > 0 && (b[0] == '+' || b[0] == '-') {
+			b = b[1:]
+		}
+		if n, _ := digits(); n == 0 {
+			return false
+		}
+	}
+	return len(b) == 0
+}
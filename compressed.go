@@ -0,0 +1,123 @@
+package pnglevel
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// recompressChunk returns data of a zTXt, iTXt, or iCCP chunk with its
+// text or profile recompressed. Uncompressed iTXt data is returned
+// unchanged.
+func (p *Reader) recompressChunk(kind string, data []byte) ([]byte, error) {
+	invalid := errors.New("pnglevel: invalid " + kind + " chunk")
+	// Keyword.
+	k := bytes.IndexByte(data, 0)
+	if k < 1 {
+		return nil, invalid
+	}
+	method, start := k+1, k+2
+	if kind == "iTXt" {
+		// Compression flag, method, language tag, and translated keyword.
+		if len(data) < k+3 {
+			return nil, invalid
+		}
+		if data[k+1] == 0 {
+			return data, nil
+		}
+		method = k + 2
+		start = k + 3
+		for n := 0; n < 2; n++ {
+			i := bytes.IndexByte(data[start:], 0)
+			if i < 0 {
+				return nil, invalid
+			}
+			start += i + 1
+		}
+	}
+	if len(data) < start {
+		return nil, invalid
+	}
+	if data[method] != 0 {
+		return nil, fmt.Errorf("%w in %s chunk", ErrUnsupportedCompression, kind)
+	}
+	z, err := p.recompress(data[start:])
+	if err != nil {
+		return nil, err
+	}
+	return append(data[:start:start], z...), nil
+}
+
+// compressText returns data of a zTXt chunk equivalent to the tEXt
+// chunk data, or nil if it wouldn't be smaller or data is malformed.
+func (p *Reader) compressText(data []byte) ([]byte, error) {
+	k := bytes.IndexByte(data, 0)
+	if k < 1 || p.verifyOnly {
+		return nil, nil
+	}
+	var out bytes.Buffer
+	out.Write(data[:k+1])
+	out.WriteByte(0) // compression method
+	zw, err := p.newChunkCompressor(&out)
+	if zw == nil || err != nil {
+		return nil, err
+	}
+	if _, err := zw.Write(data[k+1:]); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	if out.Len() >= len(data) {
+		return nil, nil
+	}
+	return out.Bytes(), nil
+}
+
+// recompress returns the zlib stream b recompressed at the target level,
+// or b if it cannot be recompressed with the configured compressor or
+// is only verified.
+func (p *Reader) recompress(b []byte) ([]byte, error) {
+	zr, err := zlib.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	var out bytes.Buffer
+	var zw io.WriteCloser
+	if !p.verifyOnly {
+		if zw, err = p.newChunkCompressor(&out); err != nil {
+			return nil, err
+		}
+	}
+	if zw == nil {
+		// Verify the stream anyway.
+		if _, err := io.Copy(io.Discard, &inflateLimiter{zr, p}); err != nil {
+			return nil, err
+		}
+		return b, nil
+	}
+	if _, err := io.Copy(zw, &inflateLimiter{zr, p}); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// newChunkCompressor returns a writer compressing data of chunks other
+// than IDAT to w: the Compressor, if set, or a zlib writer at Level.
+// It returns nil if the Compressor writes raw deflate streams for
+// RawDeflateIDAT, which other chunks cannot hold.
+func (p *Reader) newChunkCompressor(w io.Writer) (io.WriteCloser, error) {
+	if p.opts.Compressor != nil {
+		if p.opts.RawDeflateIDAT {
+			return nil, nil
+		}
+		return p.opts.Compressor.NewWriter(w)
+	}
+	return zlib.NewWriterLevel(w, p.opts.Level)
+}
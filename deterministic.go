@@ -0,0 +1,48 @@
+package pnglevel
+
+import (
+	"crypto/sha256"
+	"io"
+)
+
+// RepackDeterministic is like Repack, but guarantees that output
+// depends only on the input, the level, and the Go version, so that
+// repacking the same file gives byte-identical results on any machine.
+// It always uses the standard compressor with default options: image
+// data is passed to it as a single stream, regardless of buffer sizes
+// or how the input is split into IDAT chunks.
+//
+// Output may differ between Go versions, since compress/flate doesn't
+// promise stable output across releases, so pin the Go version when
+// reproducibility matters.
+func RepackDeterministic(w io.Writer, r io.Reader, level int) error {
+	return RepackWithOptions(w, r, deterministicOptions(level))
+}
+
+// Fingerprint returns a SHA-256 hash of the output RepackDeterministic
+// would write for the PNG file read from r with the given level,
+// without writing it anywhere.
+func Fingerprint(r io.Reader, level int) ([]byte, error) {
+	p, err := NewReaderWithOptions(r, deterministicOptions(level))
+	if err != nil {
+		return nil, err
+	}
+	defer p.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, p); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// deterministicOptions returns the options used by RepackDeterministic.
+// Image data is written in chunks of bufSize bytes. Buffer sizes don't
+// change the compressed stream, but are fixed too, so that output never
+// depends on them.
+func deterministicOptions(level int) Options {
+	return Options{
+		Level:      level,
+		BufferSize: bufSize,
+		IDATSize:   bufSize,
+	}
+}
@@ -0,0 +1,80 @@
+package pnglevel
+
+import (
+	"compress/zlib"
+	"io"
+)
+
+// estimateSample is the amount of decompressed image data
+// compressed by QuickEstimate.
+const estimateSample = 1 << 20
+
+// QuickEstimate returns the approximate size of the PNG file read from r
+// repacked at zlib.BestCompression, divided by its current size.
+//
+// Only image data is estimated: it is decompressed in full, but only its
+// first megabyte is compressed, and the ratio achieved on it is assumed
+// for the rest, which is then counted as written in a single IDAT chunk.
+// Other chunks are processed as Repack would process them, so compressed
+// text, ICC profiles, and APNG frames are recompressed in full and counted
+// at their new size. The estimate is poor for images whose beginning is
+// not representative of the whole, or for files dominated by animation
+// frames, but it's much faster than recompressing large still images.
+func QuickEstimate(r io.Reader) (float64, error) {
+	cr := &countReader{r: r}
+	s := new(sampler)
+	zw, err := zlib.NewWriterLevel(&s.compressed, zlib.BestCompression)
+	if err != nil {
+		return 0, err
+	}
+	s.zw = zw
+	p := newReader(cr, Options{Level: zlib.BestCompression})
+	p.sink = s
+	defer p.Close()
+	n, err := io.Copy(io.Discard, p)
+	if err != nil {
+		return 0, err
+	}
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+	size := float64(n)
+	if s.total > 0 {
+		ratio := float64(s.compressed) / float64(s.sampled)
+		// Add the overhead of a single IDAT chunk.
+		size += ratio*float64(s.total) + 12
+	}
+	return size / float64(cr.n), nil
+}
+
+// sampler compresses the first estimateSample bytes written to it
+// and counts the rest.
+type sampler struct {
+	zw         *zlib.Writer
+	compressed countWriter
+	sampled    int64
+	total      int64
+}
+
+func (s *sampler) Write(b []byte) (int, error) {
+	s.total += int64(len(b))
+	if n := min(len(b), int(estimateSample-s.sampled)); n > 0 {
+		s.sampled += int64(n)
+		if _, err := s.zw.Write(b[:n]); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// countReader counts bytes read from r.
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.n += int64(n)
+	return n, err
+}
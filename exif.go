@@ -0,0 +1,76 @@
+package pnglevel
+
+import "encoding/binary"
+
+// EXIF tags giving the location of the JPEG thumbnail in IFD1.
+const (
+	tagJPEGInterchangeFormat       = 0x0201
+	tagJPEGInterchangeFormatLength = 0x0202
+)
+
+// exifThumbnail returns the JPEG thumbnail stored in IFD1 of the
+// EXIF data, which is in TIFF format, or nil if there's none.
+func exifThumbnail(b []byte) []byte {
+	if len(b) < 8 {
+		return nil
+	}
+	var order binary.ByteOrder
+	switch string(b[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return nil
+	}
+	// Skip IFD0 to find IFD1.
+	ifd0 := int64(order.Uint32(b[4:8]))
+	count, ok := ifdCount(b, ifd0, order)
+	if !ok {
+		return nil
+	}
+	next := ifd0 + 2 + 12*count
+	if next+4 > int64(len(b)) {
+		return nil
+	}
+	ifd1 := int64(order.Uint32(b[next:]))
+	if ifd1 == 0 {
+		return nil
+	}
+	count, ok = ifdCount(b, ifd1, order)
+	if !ok || ifd1+2+12*count > int64(len(b)) {
+		return nil
+	}
+	var off, length int64 = -1, -1
+	for i := int64(0); i < count; i++ {
+		e := b[ifd1+2+12*i:]
+		tag, typ := order.Uint16(e[0:2]), order.Uint16(e[2:4])
+		var v int64
+		switch typ {
+		case 3: // SHORT
+			v = int64(order.Uint16(e[8:10]))
+		case 4: // LONG
+			v = int64(order.Uint32(e[8:12]))
+		default:
+			continue
+		}
+		switch tag {
+		case tagJPEGInterchangeFormat:
+			off = v
+		case tagJPEGInterchangeFormatLength:
+			length = v
+		}
+	}
+	if off < 0 || length <= 0 || off+length > int64(len(b)) {
+		return nil
+	}
+	return b[off : off+length]
+}
+
+// ifdCount returns the number of entries in the IFD at the offset.
+func ifdCount(b []byte, off int64, order binary.ByteOrder) (int64, bool) {
+	if off < 8 || off+2 > int64(len(b)) {
+		return 0, false
+	}
+	return int64(order.Uint16(b[off:])), true
+}
@@ -0,0 +1,78 @@
+package pnglevel
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+// RepackFile recompresses the PNG file at path with the given level,
+// replacing it atomically: the result is written to a temporary file
+// in the same directory, which is renamed over the original only after
+// it has been completely written and synced. On error, the original
+// file is left untouched. The replacement keeps the original file mode.
+func RepackFile(path string, level int) (err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	if err := Repack(tmp, f, level); err != nil {
+		return err
+	}
+	if err := tmp.Chmod(fi.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// RepackAll recompresses the files at paths in place with the given
+// level, like RepackFile, using up to workers goroutines. If workers is
+// zero or negative, runtime.GOMAXPROCS(0) is used. The returned slice
+// contains the error for each file at the same index as its path, or
+// nil if it was recompressed successfully. A failure doesn't stop
+// processing of other files.
+func RepackAll(paths []string, level int, workers int) []error {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	errs := make([]error, len(paths))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < min(workers, len(paths)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				errs[i] = RepackFile(paths[i], level)
+			}
+		}()
+	}
+	for i := range paths {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return errs
+}
@@ -0,0 +1,36 @@
+package pnglevel
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+)
+
+// ImageFingerprint returns a SHA-256 hash identifying the image stored
+// in the PNG file read from r, regardless of how it is encoded.
+//
+// The hash covers the image width and height as big-endian 32-bit
+// integers, followed by the pixels in the format described for
+// Options.InputPixelHash: row by row, as RGBA with 16 bits per sample,
+// with palette and transparency applied and lower bit depths scaled to
+// the full range. Color type, bit depth, interlacing, filtering,
+// compression, and chunks other than IHDR, PLTE, and tRNS don't affect
+// it, so, for example, a gray image stored as RGB has the same
+// fingerprint as the gray original.
+func ImageFingerprint(r io.Reader) ([]byte, error) {
+	h := sha256.New()
+	p := newReader(r, Options{InputPixelHash: h})
+	p.skipIDAT = true
+	var hdr [8]byte
+	if err := p.verifyHeader(); err != nil {
+		return nil, p.errorAt(err)
+	}
+	p.stage = stChunkHead
+	binary.BigEndian.PutUint32(hdr[:4], p.hdr.width)
+	binary.BigEndian.PutUint32(hdr[4:], p.hdr.height)
+	h.Write(hdr[:])
+	if _, err := io.Copy(io.Discard, p); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,88 @@
+//go:build go1.18
+// +build go1.18
+
+package pnglevel_test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/png"
+	"testing"
+
+	"github.com/dchest/pnglevel"
+)
+
+// fuzzOptions returns options selected by the bits of flags.
+func fuzzOptions(flags uint16) pnglevel.Options {
+	opts := pnglevel.Options{
+		Level:               int(flags>>12) % 10,
+		MaxDecompressedSize: 1 << 24,
+	}
+	set := func(bit uint, v *bool) { *v = flags&(1<<bit) != 0 }
+	set(0, &opts.DropOpaqueAlpha)
+	set(1, &opts.HonorSBIT)
+	set(2, &opts.Repair)
+	set(3, &opts.Canonicalize)
+	set(4, &opts.Pipeline)
+	set(5, &opts.CoalesceIDAT)
+	set(6, &opts.KeepSmaller)
+	set(7, &opts.RequireIEND)
+	set(8, &opts.IgnoreInputCRC)
+	set(9, &opts.Dedup)
+	set(10, &opts.CompressText)
+	set(11, &opts.StripAnimation)
+	opts.RecomputeOutputCRC = opts.IgnoreInputCRC
+	if flags&(1<<1) != 0 && flags&(1<<0) == 0 {
+		opts.Filter = pnglevel.FilterMinSum
+	}
+	return opts
+}
+
+// FuzzRepack checks that Reader never panics and that it either
+// returns an error or a well-formed PNG file with the same pixels.
+func FuzzRepack(f *testing.F) {
+	gray := image.NewGray(image.Rect(0, 0, 7, 5))
+	pal := image.NewPaletted(image.Rect(0, 0, 9, 3), palette.Plan9)
+	rgba := image.NewNRGBA64(image.Rect(0, 0, 4, 4))
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i * 7)
+	}
+	for i := range pal.Pix {
+		pal.Pix[i] = uint8(i * 13)
+	}
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			rgba.Set(x, y, color.NRGBA64{uint16(x << 12), uint16(y << 12), 0x1234, 0xffff})
+		}
+	}
+	for _, m := range []image.Image{gray, pal, rgba, testImage(16, 8)} {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, m); err != nil {
+			f.Fatal(err)
+		}
+		f.Add(buf.Bytes(), uint16(0))
+		f.Add(buf.Bytes(), uint16(0x9fff))
+	}
+	f.Fuzz(func(t *testing.T, data []byte, flags uint16) {
+		opts := fuzzOptions(flags)
+		var out bytes.Buffer
+		if err := pnglevel.RepackWithOptions(&out, bytes.NewReader(data), opts); err != nil {
+			return
+		}
+		for _, c := range readChunks(t, out.Bytes()) {
+			if !c.crcOK {
+				t.Fatalf("invalid checksum of %s chunk", c.typ)
+			}
+		}
+		cfg, err := png.DecodeConfig(bytes.NewReader(data))
+		if err != nil || cfg.Width*cfg.Height > 1<<16 {
+			return
+		}
+		if _, err := png.Decode(bytes.NewReader(data)); err != nil {
+			return
+		}
+		samePixels(t, data, out.Bytes())
+	})
+}
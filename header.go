@@ -0,0 +1,80 @@
+package pnglevel
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// IHDR contains the image header of a PNG file.
+type IHDR struct {
+	Width       uint32
+	Height      uint32
+	BitDepth    uint8
+	ColorType   uint8
+	Compression uint8
+	Filter      uint8
+	Interlace   uint8
+}
+
+// Header returns the image header of the input file. It returns an
+// error if IHDR has not been read yet, that is, before the first call
+// to Read or WriteTo. The header describes the input even if pixel
+// transformations change it in the output.
+func (p *Reader) Header() (IHDR, error) {
+	if !p.haveHdr {
+		return IHDR{}, errors.New("pnglevel: IHDR has not been read")
+	}
+	return p.hdr.export(), nil
+}
+
+// ReadIHDR reads the PNG signature and IHDR chunk from r, verifying
+// them, and returns the image header. It reads exactly 33 bytes,
+// consuming the header, so r must be read again from the start to
+// process the file. Unlike Reader, it allocates no buffers.
+func ReadIHDR(r io.Reader) (IHDR, error) {
+	var b [len(pngHeader) + 8 + 13 + 4]byte
+	n, err := io.ReadFull(r, b[:])
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	switch {
+	case n >= len(pngHeader) && string(b[:len(pngHeader)]) != pngHeader:
+		err = ErrNotPNG
+	case n >= 16 && string(b[12:16]) == "CgBI":
+		err = ErrAppleCgBI
+	case n >= 16 && string(b[12:16]) != "IHDR":
+		err = ErrMissingIHDR
+	case n >= 16 && binary.BigEndian.Uint32(b[8:12]) != 13:
+		err = ErrBadIHDRLength
+	}
+	if err != nil {
+		return IHDR{}, &Error{Offset: int64(n), Err: err}
+	}
+	h := parseIHDR(b[16:29])
+	e := &Error{ChunkType: "IHDR", Offset: int64(n)}
+	switch {
+	case binary.BigEndian.Uint32(b[29:]) != crc32.ChecksumIEEE(b[12:29]):
+		e.Err = ErrBadChecksum
+	case h.compression != 0:
+		e.Err = ErrUnsupportedCompression
+	case h.filter != 0:
+		e.Err = errors.New("pnglevel: unsupported filter method")
+	default:
+		return h.export(), nil
+	}
+	return IHDR{}, e
+}
+
+func (h ihdr) export() IHDR {
+	return IHDR{
+		Width:       h.width,
+		Height:      h.height,
+		BitDepth:    h.depth,
+		ColorType:   h.colorType,
+		Compression: h.compression,
+		Filter:      h.filter,
+		Interlace:   h.interlace,
+	}
+}
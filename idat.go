@@ -0,0 +1,146 @@
+package pnglevel
+
+import (
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// WriteIDAT compresses filtered image data, which consists of scanlines
+// each starting with a filter type byte, with zlib at the given level,
+// and writes it to w as IDAT chunks each carrying at most chunkSize bytes.
+func WriteIDAT(w io.Writer, filteredData []byte, level int, chunkSize int) error {
+	return WriteIDATStride(w, filteredData, 0, level, chunkSize)
+}
+
+// WriteIDATStride is like WriteIDAT, but if stride is positive, it first
+// checks that filteredData consists of whole scanlines of stride bytes,
+// including the filter type byte, and that their filter types are valid.
+func WriteIDATStride(w io.Writer, filteredData []byte, stride, level, chunkSize int) error {
+	if chunkSize <= 0 || chunkSize > maxChunkLen {
+		return errors.New("pnglevel: invalid chunk size")
+	}
+	if stride > 0 {
+		if len(filteredData)%stride != 0 {
+			return errors.New("pnglevel: image data length is not a multiple of stride")
+		}
+		for i := 0; i < len(filteredData); i += stride {
+			if filteredData[i] >= numFilters {
+				return errors.New("pnglevel: invalid filter type")
+			}
+		}
+	}
+	iw := newIDATWriter(w, chunkSize)
+	zw, err := zlib.NewWriterLevel(iw, level)
+	if err != nil {
+		return err
+	}
+	if _, err := zw.Write(filteredData); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return iw.Close()
+}
+
+// idatWriter writes data written to it as IDAT chunks
+// carrying up to size bytes.
+type idatWriter struct {
+	w    io.Writer
+	size int
+	buf  []byte
+}
+
+func newIDATWriter(w io.Writer, size int) *idatWriter {
+	return &idatWriter{w: w, size: size}
+}
+
+func (iw *idatWriter) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		m := min(len(b), iw.size-len(iw.buf))
+		iw.buf = append(iw.buf, b[:m]...)
+		b = b[m:]
+		if len(iw.buf) == iw.size {
+			if err := iw.flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Close writes the remaining data as the last chunk.
+func (iw *idatWriter) Close() error {
+	if len(iw.buf) == 0 {
+		return nil
+	}
+	return iw.flush()
+}
+
+func (iw *idatWriter) flush() error {
+	var b [8]byte
+	binary.BigEndian.PutUint32(b[:4], uint32(len(iw.buf)))
+	copy(b[4:], "IDAT")
+	if _, err := iw.w.Write(b[:]); err != nil {
+		return err
+	}
+	if _, err := iw.w.Write(iw.buf); err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint32(b[:4], chunkCRC(crc32.IEEETable, "IDAT", iw.buf))
+	if _, err := iw.w.Write(b[:4]); err != nil {
+		return err
+	}
+	iw.buf = iw.buf[:0]
+	return nil
+}
+
+// RawImageData returns a reader of the decompressed image data of the
+// PNG file read from r: the filtered scanlines, each starting with a
+// filter type byte, of all IDAT chunks. Checksums of all chunks are
+// verified. The end of image data is reported only after the rest of
+// the file has been read.
+func RawImageData(r io.Reader) (io.Reader, error) {
+	p := newReader(r, Options{})
+	p.sink = io.Discard
+	for p.stage != stIDAT {
+		if err := p.refill(); err != nil {
+			if err == io.EOF {
+				err = ErrNoImageData
+			}
+			return nil, p.errorAt(err)
+		}
+		p.w.Reset()
+	}
+	return &rawImageReader{p: p}, nil
+}
+
+// rawImageReader reads decompressed image data from its Reader.
+type rawImageReader struct {
+	p   *Reader
+	err error
+}
+
+func (r *rawImageReader) Read(b []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.p.zr.Read(b)
+	if err == io.EOF {
+		// Finish reading the file, discarding output.
+		for err = r.p.refill(); err == nil; err = r.p.refill() {
+			r.p.w.Reset()
+		}
+	}
+	if err != nil {
+		if err != io.EOF {
+			err = r.p.errorAt(err)
+		}
+		r.err = err
+	}
+	return n, err
+}
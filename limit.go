@@ -0,0 +1,104 @@
+package pnglevel
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// limiter bounds the number of compressions running at once
+// across all Readers.
+var limiter struct {
+	mu  sync.Mutex
+	sem chan struct{} // nil if unlimited
+}
+
+// SetMaxCompressionConcurrency limits the number of image data
+// compressions that run at the same time in the process to n,
+// regardless of how many Readers are in use. Readers wait for their
+// turn before compressing each block. If n is zero or negative,
+// there is no limit, which is the default.
+//
+// Changing the limit doesn't affect compressions already waiting.
+func SetMaxCompressionConcurrency(n int) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	if n <= 0 {
+		limiter.sem = nil
+		return
+	}
+	limiter.sem = make(chan struct{}, n)
+}
+
+// acquireCompression waits until a compression can run and
+// returns a function that must be called when it is finished.
+func acquireCompression() (release func()) {
+	limiter.mu.Lock()
+	sem := limiter.sem
+	limiter.mu.Unlock()
+	if sem == nil {
+		return func() {}
+	}
+	sem <- struct{}{}
+	return func() { <-sem }
+}
+
+// pacer is a token bucket limiting the rate at which input is consumed.
+// It holds up to a second's worth of tokens.
+type pacer struct {
+	rate   float64 // bytes per second
+	tokens float64
+	last   time.Time
+}
+
+// wait blocks until n bytes may be consumed or ctx, if not nil, is done.
+func (pc *pacer) wait(ctx context.Context, n int) error {
+	now := time.Now()
+	if pc.last.IsZero() {
+		pc.tokens = pc.rate
+	} else {
+		pc.tokens += now.Sub(pc.last).Seconds() * pc.rate
+		if pc.tokens > pc.rate {
+			pc.tokens = pc.rate
+		}
+	}
+	pc.last = now
+	pc.tokens -= float64(n)
+	if pc.tokens < 0 {
+		d := time.Duration(-pc.tokens / pc.rate * float64(time.Second))
+		pc.last = now.Add(d)
+		pc.tokens = 0
+		if ctx == nil {
+			time.Sleep(d)
+			return nil
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// pacedReader limits the rate of reads from the input of a Reader.
+// Each read is paced after it returns, by the number of bytes actually
+// read, and is at most a second's worth of bytes, so that a single
+// wait is bounded.
+type pacedReader struct {
+	p  *Reader
+	pc pacer
+}
+
+func (r *pacedReader) Read(b []byte) (int, error) {
+	if limit := int(r.pc.rate); len(b) > limit {
+		b = b[:limit]
+	}
+	n, err := r.p.in.Read(b)
+	if werr := r.pc.wait(r.p.ctx, n); werr != nil {
+		return n, werr
+	}
+	return n, err
+}
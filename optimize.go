@@ -0,0 +1,49 @@
+package pnglevel
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+)
+
+// Optimize recompresses the PNG file read from r with each of the given
+// levels, or with all levels from zlib.BestSpeed to zlib.BestCompression
+// followed by zlib.HuffmanOnly if none are given, writes the smallest
+// result to w, and returns the level that produced it. Ties go to the
+// level listed first.
+//
+// The input is read into memory once. Original image data is kept when
+// recompression doesn't make it smaller, as with Options.KeepSmaller,
+// and if the result is still larger than the input, the input is
+// written unchanged, so the output is never larger than the input.
+func Optimize(w io.Writer, r io.Reader, levels ...int) (int, error) {
+	if len(levels) == 0 {
+		for level := zlib.BestSpeed; level <= zlib.BestCompression; level++ {
+			levels = append(levels, level)
+		}
+		levels = append(levels, zlib.HuffmanOnly)
+	}
+	src, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	var best, out bytes.Buffer
+	bestLevel := levels[0]
+	for i, level := range levels {
+		out.Reset()
+		err := RepackWithOptions(&out, bytes.NewReader(src), Options{Level: level, KeepSmaller: true})
+		if err != nil {
+			return 0, err
+		}
+		if i == 0 || out.Len() < best.Len() {
+			best, out = out, best
+			bestLevel = level
+		}
+	}
+	if best.Len() > len(src) {
+		_, err = w.Write(src)
+	} else {
+		_, err = w.Write(best.Bytes())
+	}
+	return bestLevel, err
+}
@@ -0,0 +1,171 @@
+package pnglevel
+
+import (
+	"compress/zlib"
+	"io"
+)
+
+// pipelineReader decompresses data read from src in another goroutine.
+// Compressed data is read from src on the caller's goroutine, so that
+// only decompression, which doesn't touch the state of a Reader,
+// runs concurrently, and blocks are handed over through channels.
+// Two buffers of each kind are in flight: one is being filled while
+// the other is being consumed.
+type pipelineReader struct {
+	src     io.Reader
+	in      chan []byte // compressed blocks, closed at the end of src
+	free    chan []byte // compressed buffers consumed by the goroutine
+	out     chan inflated
+	spare   chan []byte // decompressed buffers consumed by Read
+	quit    chan struct{}
+	done    chan struct{}
+	pending []byte // compressed block not yet sent
+	srcDone bool
+	cur     []byte // decompressed data not yet returned
+	last    []byte // buffer of cur
+	err     error  // error of the goroutine, returned after cur
+}
+
+// inflated is a block of decompressed data and the error, if any,
+// which ended decompression.
+type inflated struct {
+	b   []byte
+	err error
+}
+
+// newPipelineReader starts decompressing data read from src in blocks
+// of size bytes.
+func newPipelineReader(src io.Reader, size int) *pipelineReader {
+	r := &pipelineReader{
+		src:   src,
+		in:    make(chan []byte),
+		free:  make(chan []byte, 2),
+		out:   make(chan inflated),
+		spare: make(chan []byte, 2),
+		quit:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	for i := 0; i < 2; i++ {
+		r.free <- make([]byte, size)
+		r.spare <- make([]byte, size)
+	}
+	go r.inflate(&chanReader{in: r.in, free: r.free, quit: r.quit})
+	return r
+}
+
+// inflate runs in the goroutine, decompressing blocks read from cr
+// into spare buffers and sending them to r.out.
+func (r *pipelineReader) inflate(cr *chanReader) {
+	defer close(r.done)
+	zr, err := zlib.NewReader(cr)
+	if err == nil {
+		defer zr.Close()
+	}
+	for {
+		var buf []byte
+		select {
+		case buf = <-r.spare:
+		case <-r.quit:
+			return
+		}
+		n := 0
+		if err == nil {
+			n, err = zr.Read(buf)
+		}
+		select {
+		case r.out <- inflated{buf[:n], err}:
+		case <-r.quit:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (r *pipelineReader) Read(b []byte) (int, error) {
+	for len(r.cur) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.last != nil {
+			r.spare <- r.last[:cap(r.last)]
+			r.last = nil
+		}
+		var in chan<- []byte
+		var free <-chan []byte
+		if r.pending != nil {
+			in = r.in
+		} else if !r.srcDone {
+			free = r.free
+		}
+		select {
+		case res := <-r.out:
+			r.cur, r.last, r.err = res.b, res.b, res.err
+		case in <- r.pending:
+			r.pending = nil
+		case buf := <-free:
+			n, err := r.src.Read(buf)
+			if n > 0 {
+				r.pending = buf[:n]
+			} else {
+				r.free <- buf
+			}
+			if err == io.EOF {
+				r.srcDone = true
+			} else if err != nil {
+				return 0, err
+			}
+		}
+		if r.srcDone && r.pending == nil && r.in != nil {
+			close(r.in)
+			r.in = nil
+		}
+	}
+	n := copy(b, r.cur)
+	r.cur = r.cur[n:]
+	return n, nil
+}
+
+// Close stops the goroutine, waiting for it to finish decompressing
+// the current block.
+func (r *pipelineReader) Close() error {
+	select {
+	case <-r.quit:
+	default:
+		close(r.quit)
+	}
+	<-r.done
+	return nil
+}
+
+// chanReader reads blocks received from a channel, returning each
+// block to free once it is consumed.
+type chanReader struct {
+	in   <-chan []byte
+	free chan<- []byte
+	quit <-chan struct{}
+	cur  []byte
+	buf  []byte
+}
+
+func (r *chanReader) Read(b []byte) (int, error) {
+	for len(r.cur) == 0 {
+		if r.buf != nil {
+			r.free <- r.buf[:cap(r.buf)]
+			r.buf = nil
+		}
+		select {
+		case blk, ok := <-r.in:
+			if !ok {
+				return 0, io.EOF
+			}
+			r.cur, r.buf = blk, blk
+		case <-r.quit:
+			return 0, io.ErrClosedPipe
+		}
+	}
+	n := copy(b, r.cur)
+	r.cur = r.cur[n:]
+	return n, nil
+}
@@ -0,0 +1,714 @@
+package pnglevel
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Color types.
+const (
+	ctGray      = 0
+	ctRGB       = 2
+	ctPalette   = 3
+	ctGrayAlpha = 4
+	ctRGBA      = 6
+)
+
+// Filter types.
+const (
+	ftNone = iota
+	ftSub
+	ftUp
+	ftAverage
+	ftPaeth
+	numFilters
+)
+
+// ihdr holds the fields of an IHDR chunk.
+type ihdr struct {
+	width       uint32
+	height      uint32
+	depth       uint8
+	colorType   uint8
+	compression uint8
+	filter      uint8
+	interlace   uint8
+}
+
+func parseIHDR(b []byte) ihdr {
+	return ihdr{
+		width:       binary.BigEndian.Uint32(b[0:4]),
+		height:      binary.BigEndian.Uint32(b[4:8]),
+		depth:       b[8],
+		colorType:   b[9],
+		compression: b[10],
+		filter:      b[11],
+		interlace:   b[12],
+	}
+}
+
+func (h ihdr) bytes() []byte {
+	b := make([]byte, 13)
+	binary.BigEndian.PutUint32(b[0:4], h.width)
+	binary.BigEndian.PutUint32(b[4:8], h.height)
+	b[8] = h.depth
+	b[9] = h.colorType
+	b[10] = h.compression
+	b[11] = h.filter
+	b[12] = h.interlace
+	return b
+}
+
+// maxRawSize limits the length of decompressed image data that is
+// kept in memory to transform pixels.
+const maxRawSize = 1 << 34
+
+// errShortImageData is returned when decompressed image data
+// ends before the last scanline.
+var errShortImageData = errors.New("pnglevel: not enough image data")
+
+// validate checks that the header describes an image that
+// can be decoded into scanlines and held in memory.
+func (h ihdr) validate() error {
+	if h.width == 0 || h.height == 0 || h.width > maxChunkLen || h.height > maxChunkLen {
+		return fmt.Errorf("%w dimensions", ErrInvalidImage)
+	}
+	var ok bool
+	switch h.colorType {
+	case ctGray:
+		ok = h.depth == 1 || h.depth == 2 || h.depth == 4 || h.depth == 8 || h.depth == 16
+	case ctPalette:
+		ok = h.depth == 1 || h.depth == 2 || h.depth == 4 || h.depth == 8
+	case ctRGB, ctGrayAlpha, ctRGBA:
+		ok = h.depth == 8 || h.depth == 16
+	}
+	if !ok {
+		return fmt.Errorf("%w: invalid combination of color type and bit depth", ErrInvalidImage)
+	}
+	if h.interlace > 1 {
+		return fmt.Errorf("%w: unsupported interlace method", ErrInvalidImage)
+	}
+	// Check the size of a non-interlaced image without overflow first:
+	// interlacing adds at most a few scanlines to it, so rawSize can't
+	// overflow after that.
+	row := (uint64(h.width)*uint64(h.channels())*uint64(h.depth)+7)/8 + 1
+	if row > maxRawSize/uint64(h.height) || h.rawSize() > maxRawSize || h.rawSize() > int64(maxInt) {
+		return fmt.Errorf("%w: image is too large", ErrInvalidImage)
+	}
+	return nil
+}
+
+// channels returns the number of samples per pixel.
+func (h ihdr) channels() int {
+	switch h.colorType {
+	case ctRGB:
+		return 3
+	case ctGrayAlpha:
+		return 2
+	case ctRGBA:
+		return 4
+	}
+	return 1
+}
+
+// bpp returns the number of bytes per complete pixel, rounded up
+// to one, as used by filters.
+func (h ihdr) bpp() int {
+	n := h.channels() * int(h.depth) / 8
+	if n == 0 {
+		return 1
+	}
+	return n
+}
+
+// rowBytes returns the length of a scanline of the given width,
+// excluding the filter type byte.
+func (h ihdr) rowBytes(width int) int {
+	return (width*h.channels()*int(h.depth) + 7) / 8
+}
+
+// adam7 describes the starting offsets and steps of each Adam7 pass.
+var adam7 = [7]struct{ x, y, dx, dy int }{
+	{0, 0, 8, 8},
+	{4, 0, 8, 8},
+	{0, 4, 4, 8},
+	{2, 0, 4, 4},
+	{0, 2, 2, 4},
+	{1, 0, 2, 2},
+	{0, 1, 1, 2},
+}
+
+// pass is the size of one reduced image of an interlaced image,
+// or of the whole image when it's not interlaced.
+type pass struct {
+	width, height int
+}
+
+// passes returns the reduced images in the order their scanlines
+// appear in the image data. Empty passes are omitted.
+func (h ihdr) passes() []pass {
+	w, ht := int(h.width), int(h.height)
+	if h.interlace == 0 {
+		return []pass{{w, ht}}
+	}
+	var ps []pass
+	for _, a := range adam7 {
+		pw := (w - a.x + a.dx - 1) / a.dx
+		ph := (ht - a.y + a.dy - 1) / a.dy
+		if pw > 0 && ph > 0 {
+			ps = append(ps, pass{pw, ph})
+		}
+	}
+	return ps
+}
+
+// rawSize returns the length of decompressed image data,
+// including filter type bytes.
+func (h ihdr) rawSize() int64 {
+	var n int64
+	for _, ps := range h.passes() {
+		n += int64(ps.height) * int64(1+h.rowBytes(ps.width))
+	}
+	return n
+}
+
+// eachRow calls fn for every scanline in data, including its filter
+// type byte, along with the previous scanline of the same pass, which
+// is nil for the first one.
+func (h ihdr) eachRow(data []byte, fn func(width int, prev, cur []byte) error) error {
+	for _, ps := range h.passes() {
+		n := 1 + h.rowBytes(ps.width)
+		var prev []byte
+		for y := 0; y < ps.height; y++ {
+			if len(data) < n {
+				return errShortImageData
+			}
+			cur := data[:n]
+			data = data[n:]
+			if err := fn(ps.width, prev, cur); err != nil {
+				return err
+			}
+			prev = cur
+		}
+	}
+	return nil
+}
+
+// unfilter reconstructs scanlines in place. Filter type bytes are kept.
+func unfilter(h ihdr, data []byte) error {
+	bpp := h.bpp()
+	return h.eachRow(data, func(_ int, prev, cur []byte) error {
+		var up []byte
+		if prev != nil {
+			up = prev[1:]
+		}
+		row := cur[1:]
+		switch cur[0] {
+		case ftNone:
+		case ftSub:
+			for i := bpp; i < len(row); i++ {
+				row[i] += row[i-bpp]
+			}
+		case ftUp:
+			for i := range up {
+				row[i] += up[i]
+			}
+		case ftAverage:
+			for i := range row {
+				var a, b int
+				if i >= bpp {
+					a = int(row[i-bpp])
+				}
+				if up != nil {
+					b = int(up[i])
+				}
+				row[i] += uint8((a + b) / 2)
+			}
+		case ftPaeth:
+			for i := range row {
+				var a, b, c uint8
+				if i >= bpp {
+					a = row[i-bpp]
+				}
+				if up != nil {
+					b = up[i]
+					if i >= bpp {
+						c = up[i-bpp]
+					}
+				}
+				row[i] += paeth(a, b, c)
+			}
+		default:
+			return errors.New("pnglevel: invalid filter type")
+		}
+		return nil
+	})
+}
+
+// filterRow writes row filtered with filter type ft into dst.
+// The previous unfiltered row is up, or nil for the first row.
+func filterRow(dst, row, up []byte, ft uint8, bpp int) {
+	for i := range row {
+		var a, b, c uint8
+		if i >= bpp {
+			a = row[i-bpp]
+		}
+		if up != nil {
+			b = up[i]
+			if i >= bpp {
+				c = up[i-bpp]
+			}
+		}
+		switch ft {
+		case ftNone:
+			dst[i] = row[i]
+		case ftSub:
+			dst[i] = row[i] - a
+		case ftUp:
+			dst[i] = row[i] - b
+		case ftAverage:
+			dst[i] = row[i] - uint8((int(a)+int(b))/2)
+		case ftPaeth:
+			dst[i] = row[i] - paeth(a, b, c)
+		}
+	}
+}
+
+// refilter returns unfiltered data filtered again using the filter type
+// stored at the start of each scanline.
+func refilter(h ihdr, data []byte) []byte {
+	out := make([]byte, len(data))
+	off := 0
+	bpp := h.bpp()
+	h.eachRow(data, func(_ int, prev, cur []byte) error {
+		var up []byte
+		if prev != nil {
+			up = prev[1:]
+		}
+		out[off] = cur[0]
+		filterRow(out[off+1:off+len(cur)], cur[1:], up, cur[0], bpp)
+		off += len(cur)
+		return nil
+	})
+	return out
+}
+
+func paeth(a, b, c uint8) uint8 {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	if pa <= pb && pa <= pc {
+		return a
+	}
+	if pb <= pc {
+		return b
+	}
+	return c
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// dropOpaqueAlpha removes the alpha channel from unfiltered data of a
+// gray+alpha or RGBA image if every pixel is fully opaque. It returns
+// the new header and data, and whether the conversion was done.
+//
+// If transparent pixels are all fully transparent and share a single
+// color not used by any opaque pixel, the image is converted too, and
+// the returned trns holds contents of a tRNS chunk for that color.
+func dropOpaqueAlpha(h ihdr, data []byte) (nh ihdr, out, trns []byte, ok bool) {
+	if h.colorType != ctGrayAlpha && h.colorType != ctRGBA {
+		return h, nil, nil, false
+	}
+	size := int(h.depth) / 8           // bytes per sample
+	color := (h.channels() - 1) * size // bytes of color per pixel
+	pixel := color + size              // bytes per pixel
+	alpha := func(px []byte) (opaque, transparent bool) {
+		opaque, transparent = true, true
+		for _, b := range px[color:pixel] {
+			opaque = opaque && b == 0xff
+			transparent = transparent && b == 0
+		}
+		return
+	}
+	var key []byte
+	err := h.eachRow(data, func(_ int, _, cur []byte) error {
+		for i := 1; i < len(cur); i += pixel {
+			opaque, transparent := alpha(cur[i:])
+			switch {
+			case opaque:
+			case !transparent:
+				return errors.New("partially transparent")
+			case key == nil:
+				key = cur[i : i+color]
+			case !bytes.Equal(key, cur[i:i+color]):
+				return errors.New("many transparent colors")
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return h, nil, nil, false
+	}
+	if key != nil {
+		// Make sure no opaque pixel has the key color.
+		err := h.eachRow(data, func(_ int, _, cur []byte) error {
+			for i := 1; i < len(cur); i += pixel {
+				if opaque, _ := alpha(cur[i:]); opaque && bytes.Equal(key, cur[i:i+color]) {
+					return errors.New("key color is opaque")
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return h, nil, nil, false
+		}
+		// tRNS stores 16-bit samples.
+		for i := 0; i < len(key); i += size {
+			if size == 1 {
+				trns = append(trns, 0)
+			}
+			trns = append(trns, key[i:i+size]...)
+		}
+	}
+	nh = h
+	if h.colorType == ctRGBA {
+		nh.colorType = ctRGB
+	} else {
+		nh.colorType = ctGray
+	}
+	out = make([]byte, 0, nh.rawSize())
+	h.eachRow(data, func(_ int, _, cur []byte) error {
+		out = append(out, cur[0])
+		for i := 1; i < len(cur); i += pixel {
+			out = append(out, cur[i:i+color]...)
+		}
+		return nil
+	})
+	return nh, out, trns, true
+}
+
+// FilterHeuristic selects how scanline filters are chosen
+// for recompressed image data.
+type FilterHeuristic int
+
+const (
+	// FilterNone keeps the filters of the input image.
+	FilterNone FilterHeuristic = iota
+
+	// FilterMinSum chooses, for each scanline, the filter that
+	// minimizes the sum of absolute values of filtered bytes
+	// taken as signed.
+	FilterMinSum
+
+	// FilterEntropy chooses, for each scanline, the filter that
+	// minimizes the entropy of filtered bytes.
+	FilterEntropy
+
+	// FilterBruteForce compresses each scanline with every filter
+	// and chooses the one that produces the smallest result.
+	// It is very slow.
+	FilterBruteForce
+)
+
+// chooseFilters replaces the filter type byte of each unfiltered
+// scanline in data with the one selected by the heuristic.
+// Images with palette or bit depth below 8 are always unfiltered,
+// as recommended by the PNG specification, unless brute force
+// is used.
+func chooseFilters(h ihdr, data []byte, fh FilterHeuristic, level int) error {
+	if fh == FilterNone {
+		return nil
+	}
+	if fh != FilterBruteForce && (h.colorType == ctPalette || h.depth < 8) {
+		return h.eachRow(data, func(_ int, _, cur []byte) error {
+			cur[0] = ftNone
+			return nil
+		})
+	}
+	var zw *flate.Writer
+	var cw countWriter
+	if fh == FilterBruteForce {
+		var err error
+		zw, err = flate.NewWriter(&cw, level)
+		if err != nil {
+			return err
+		}
+	}
+	bpp := h.bpp()
+	var tmp [numFilters][]byte
+	return h.eachRow(data, func(_ int, prev, cur []byte) error {
+		var up []byte
+		if prev != nil {
+			up = prev[1:]
+		}
+		row := cur[1:]
+		best, bestCost := 0, int64(-1)
+		for ft := range tmp {
+			if cap(tmp[ft]) < len(row) {
+				tmp[ft] = make([]byte, len(row))
+			}
+			tmp[ft] = tmp[ft][:len(row)]
+			filterRow(tmp[ft], row, up, uint8(ft), bpp)
+			var cost int64
+			switch fh {
+			case FilterMinSum:
+				for _, b := range tmp[ft] {
+					cost += int64(abs(int(int8(b))))
+				}
+			case FilterEntropy:
+				cost = entropyCost(tmp[ft])
+			case FilterBruteForce:
+				cw = 0
+				zw.Reset(&cw)
+				zw.Write(tmp[ft])
+				zw.Close()
+				cost = int64(cw)
+			}
+			if bestCost < 0 || cost < bestCost {
+				best, bestCost = ft, cost
+			}
+		}
+		cur[0] = uint8(best)
+		return nil
+	})
+}
+
+// entropyCost returns the Shannon entropy of b in bits, scaled by
+// 1024 and truncated, which is enough to compare rows.
+func entropyCost(b []byte) int64 {
+	var counts [256]int
+	for _, c := range b {
+		counts[c]++
+	}
+	var e float64
+	n := float64(len(b))
+	for _, c := range counts {
+		if c > 0 {
+			f := float64(c)
+			e -= f * math.Log2(f/n)
+		}
+	}
+	return int64(e * 1024)
+}
+
+// countWriter counts bytes written to it.
+type countWriter int64
+
+func (w *countWriter) Write(b []byte) (int, error) {
+	*w += countWriter(len(b))
+	return len(b), nil
+}
+
+// sample returns the i-th sample of an unfiltered scanline,
+// excluding its filter type byte.
+func (h ihdr) sample(row []byte, i int) uint16 {
+	switch h.depth {
+	case 16:
+		return uint16(row[2*i])<<8 | uint16(row[2*i+1])
+	case 8:
+		return uint16(row[i])
+	}
+	d := int(h.depth)
+	bit := i * d
+	return uint16(row[bit/8]>>(8-d-bit%8)) & (1<<d - 1)
+}
+
+// writePixels writes pixels of unfiltered image data to w in row-major
+// order as RGBA, 16 bits per sample, big-endian, with samples of lower
+// bit depth scaled to the full range. Palette is looked up in plte, and
+// transparency comes from trns, which may be nil.
+func writePixels(w io.Writer, h ihdr, data, plte, trns []byte) error {
+	// Find scanlines of each pass in data.
+	type passRows struct {
+		x, y, dx, dy int
+		off, stride  int
+	}
+	var ps []passRows
+	steps := adam7[:]
+	if h.interlace == 0 {
+		steps = []struct{ x, y, dx, dy int }{{0, 0, 1, 1}}
+	}
+	off := 0
+	for _, a := range steps {
+		pw := (int(h.width) - a.x + a.dx - 1) / a.dx
+		ph := (int(h.height) - a.y + a.dy - 1) / a.dy
+		pr := passRows{a.x, a.y, a.dx, a.dy, off, 1 + h.rowBytes(pw)}
+		if pw > 0 && ph > 0 {
+			off += ph * pr.stride
+		}
+		ps = append(ps, pr)
+	}
+	// Index of pass containing each pixel of an 8x8 block.
+	var which [8][8]int
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			for k, pr := range ps {
+				if x%pr.dx == pr.x && y%pr.dy == pr.y {
+					which[y][x] = k
+					break
+				}
+			}
+		}
+	}
+	channels := h.channels()
+	max := uint32(1)<<h.depth - 1
+	scale := func(v uint16) uint16 {
+		return uint16(uint32(v) * 0xffff / max)
+	}
+	out := make([]byte, 8*int(h.width))
+	var px [4]uint16
+	for y := 0; y < int(h.height); y++ {
+		for x := 0; x < int(h.width); x++ {
+			pr := ps[which[y%8][x%8]]
+			row := data[pr.off+(y-pr.y)/pr.dy*pr.stride+1:]
+			i := (x - pr.x) / pr.dx * channels
+			switch h.colorType {
+			case ctGray:
+				v := h.sample(row, i)
+				px = [4]uint16{scale(v), scale(v), scale(v), 0xffff}
+				if len(trns) >= 2 && v == binary.BigEndian.Uint16(trns) {
+					px[3] = 0
+				}
+			case ctRGB:
+				r, g, b := h.sample(row, i), h.sample(row, i+1), h.sample(row, i+2)
+				px = [4]uint16{scale(r), scale(g), scale(b), 0xffff}
+				if len(trns) >= 6 && r == binary.BigEndian.Uint16(trns) &&
+					g == binary.BigEndian.Uint16(trns[2:]) && b == binary.BigEndian.Uint16(trns[4:]) {
+					px[3] = 0
+				}
+			case ctPalette:
+				v := int(h.sample(row, i))
+				px = [4]uint16{0, 0, 0, 0xffff}
+				if 3*v+2 < len(plte) {
+					px[0] = uint16(plte[3*v]) * 0x101
+					px[1] = uint16(plte[3*v+1]) * 0x101
+					px[2] = uint16(plte[3*v+2]) * 0x101
+				}
+				if v < len(trns) {
+					px[3] = uint16(trns[v]) * 0x101
+				}
+			case ctGrayAlpha:
+				v := scale(h.sample(row, i))
+				px = [4]uint16{v, v, v, scale(h.sample(row, i+1))}
+			case ctRGBA:
+				for c := range px {
+					px[c] = scale(h.sample(row, i+c))
+				}
+			}
+			for c, v := range px {
+				binary.BigEndian.PutUint16(out[8*x+2*c:], v)
+			}
+		}
+		if _, err := w.Write(out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reduceDepth lowers the bit depth of unfiltered image data to the
+// smallest one allowed for its color type that is at least the number
+// of significant bits given by sbit, if no information is lost: every
+// sample, as well as the tRNS and bKGD values given by trns and bkgd,
+// must be an exact multiple of the scale factor between the depths.
+// It returns the new header, data, tRNS and bKGD contents, and whether
+// the reduction was done.
+func reduceDepth(h ihdr, data, sbit, trns, bkgd []byte) (nh ihdr, out, ntrns, nbkgd []byte, ok bool) {
+	if h.colorType == ctPalette || len(sbit) == 0 {
+		return h, nil, nil, nil, false
+	}
+	var sig uint8
+	for _, b := range sbit {
+		if b > sig {
+			sig = b
+		}
+	}
+	var depths []uint8
+	if h.colorType == ctGray {
+		depths = []uint8{1, 2, 4, 8}
+	} else {
+		depths = []uint8{8}
+	}
+	depth := uint8(0)
+	for _, d := range depths {
+		if d >= sig && d < h.depth {
+			depth = d
+			break
+		}
+	}
+	if depth == 0 {
+		return h, nil, nil, nil, false
+	}
+	factor := uint16((1<<uint(h.depth) - 1) / (1<<uint(depth) - 1))
+	// Check that low bits carry no information.
+	err := h.eachRow(data, func(width int, _, cur []byte) error {
+		for i := 0; i < width*h.channels(); i++ {
+			if h.sample(cur[1:], i)%factor != 0 {
+				return errors.New("lossy")
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return h, nil, nil, nil, false
+	}
+	// tRNS and bKGD store 16-bit samples.
+	rescale := func(b []byte) ([]byte, bool) {
+		if b == nil {
+			return nil, true
+		}
+		if len(b)%2 != 0 {
+			return nil, false
+		}
+		nb := make([]byte, len(b))
+		for i := 0; i < len(b); i += 2 {
+			v := binary.BigEndian.Uint16(b[i:])
+			if v%factor != 0 {
+				return nil, false
+			}
+			binary.BigEndian.PutUint16(nb[i:], v/factor)
+		}
+		return nb, true
+	}
+	if ntrns, ok = rescale(trns); !ok {
+		return h, nil, nil, nil, false
+	}
+	if nbkgd, ok = rescale(bkgd); !ok {
+		return h, nil, nil, nil, false
+	}
+	nh = h
+	nh.depth = depth
+	out = make([]byte, 0, nh.rawSize())
+	h.eachRow(data, func(width int, _, cur []byte) error {
+		out = append(out, cur[0])
+		var acc uint32
+		var bits uint
+		for i := 0; i < width*h.channels(); i++ {
+			v := h.sample(cur[1:], i) / factor
+			if depth == 8 {
+				out = append(out, uint8(v))
+				continue
+			}
+			acc = acc<<depth | uint32(v)
+			bits += uint(depth)
+			if bits == 8 {
+				out = append(out, uint8(acc))
+				acc, bits = 0, 0
+			}
+		}
+		if bits > 0 {
+			out = append(out, uint8(acc<<(8-bits)))
+		}
+		return nil
+	})
+	return nh, out, ntrns, nbkgd, true
+}
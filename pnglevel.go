@@ -1,15 +1,25 @@
 // Package pnglevel changes zlib compression level of PNG files.
+//
+// Input is consumed strictly forward: the package never seeks or
+// rewinds the source, so non-seekable readers, such as archive
+// entries or network streams, can be used directly. Options that
+// need to revisit data buffer it in memory instead.
 package pnglevel
 
 import (
+	"bufio"
 	"bytes"
+	"compress/flate"
 	"compress/zlib"
+	"context"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"hash"
 	"hash/crc32"
 	"io"
+	"math"
 )
 
 const (
@@ -17,6 +27,8 @@ const (
 	maxChunkLen = 0x7fffffff
 
 	bufSize = 32768 // zlib reads in blocks of 32K
+
+	maxIHDRPadding = 4 // extra IHDR bytes discarded in repair mode
 )
 
 const (
@@ -29,59 +41,919 @@ const (
 
 type Reader struct {
 	r             io.Reader
+	in            countReader
 	w             bytes.Buffer
-	level         int
+	opts          Options
+	verbatim      map[string]bool
+	diagHead      [8]byte
+	diagData      []byte
+	hdr           ihdr
+	haveHdr       bool // hdr has been read
+	pixels        bool
+	hold          bool
+	trailer       []rawChunk      // chunks to write before IEND
+	inserts       []rawChunk      // chunks to write before image data
+	orig          *bytes.Buffer   // copy of input for MaxGrowthFactor
+	origIDAT      *bytes.Buffer   // copy of image data for KeepSmaller
+	origLayout    []int           // lengths of input IDAT chunks for KeepSmaller
+	keepOrig      bool            // recompression abandoned for SkipIfNotBeneficial
+	idatLayout    []int           // lengths of input IDAT chunks for PreserveIDATLayout
+	strays        []rawChunk      // chunks found between IDAT chunks, for Repair
+	ctx           context.Context // checked for cancellation, if set
+	sink          io.Writer       // receives decompressed image data instead of zw
+	idatIn        int64           // compressed image data bytes read
+	idatOut       int64           // compressed image data bytes written
+	chunks        int             // number of chunks read
+	out           int64           // output bytes returned
+	inflated      int64           // decompressed bytes read
+	skipIDAT      bool            // process image data without writing it
+	verifyOnly    bool            // decompress chunk data without recompressing it
 	tmp           [13]byte
+	head          [8]byte // header of the current chunk
 	crc           hash.Hash32
 	readNonIDAT   bool
+	sawIEND       bool
+	sentSig       bool   // signature has been consumed for ChunkSink
+	skip          bool   // don't write the current chunk
+	frame         []byte // compressed data of the current APNG frame
+	frameLayout   []int  // lengths of fdAT chunk data of the frame
+	inFrame       bool
+	seq           uint32 // next APNG sequence number
 	processedIDAT bool
 	buf           []byte
 	stage         int
+	start         int // initial stage
 	chunkLen      int
 	chunkType     string
+	chunkSize     int // data length of the current chunk
 	zr            io.ReadCloser
-	zw            *zlib.Writer
+	zw            io.WriteCloser
 	zbuf          bytes.Buffer
-	zcrc          hash.Hash32
 	eof           bool
+	aborted       bool
+	seen          map[[sha256.Size]byte]bool // hashes of chunks for Dedup
+
+	// zlib state kept for reuse by Reset.
+	zlibR     io.ReadCloser
+	zlibW     *zlib.Writer
+	zlibLevel int // level of zlibW
 }
 
+// ErrAborted is returned by Read after Abort has been called.
+var ErrAborted = errors.New("pnglevel: aborted")
+
+// ErrDecompressedTooLarge is returned, wrapped in *Error, when
+// decompressed data exceeds Options.MaxDecompressedSize.
+var ErrDecompressedTooLarge = errors.New("pnglevel: decompressed data is too large")
+
+// ErrOutputTooLarge is returned when output exceeds Options.MaxOutputSize.
+var ErrOutputTooLarge = errors.New("pnglevel: output is too large")
+
+// ErrTooManyChunks is returned when the file has more chunks
+// than Options.MaxChunks.
+var ErrTooManyChunks = errors.New("pnglevel: too many chunks")
+
+// Errors returned for malformed or unsupported input. They may be
+// wrapped with details, so use errors.Is to check for them.
+var (
+	ErrNotPNG                 = errors.New("pnglevel: not a PNG file")
+	ErrMissingIHDR            = errors.New("pnglevel: missing IHDR")
+	ErrBadIHDRLength          = errors.New("pnglevel: incorrect IHDR length")
+	ErrUnsupportedCompression = errors.New("pnglevel: unsupported compression method")
+	ErrBadChecksum            = errors.New("pnglevel: invalid checksum")
+	ErrChunkTooBig            = errors.New("pnglevel: chunk is too big")
+	ErrWrongIDATOrder         = errors.New("pnglevel: wrong IDAT order")
+	ErrMissingIEND            = errors.New("pnglevel: missing IEND")
+	ErrNoImageData            = errors.New("pnglevel: no image data")
+	ErrInvalidImage           = errors.New("pnglevel: invalid image")
+
+	// ErrAppleCgBI is returned for Apple's iOS-optimized PNG files,
+	// which have a CgBI chunk before IHDR and store image data as
+	// raw deflate with byte-swapped color channels. Such files are
+	// not valid PNG, and converting them is not supported.
+	ErrAppleCgBI = errors.New("pnglevel: Apple CgBI file is not supported")
+
+	// ErrTruncated matches errors returned for input that ends in the
+	// middle of the file: io.ErrUnexpectedEOF, when it ends inside a
+	// chunk or before image data, and ErrMissingIEND, when it ends
+	// after a complete chunk before IEND. Real read errors of the
+	// underlying reader are returned as they are.
+	ErrTruncated = errors.New("pnglevel: truncated file")
+)
+
+// Repack reads a PNG file from the given io.Reader and
+// writes it recompressed with the given level to io.Writer.
+//
+// An invalid level is reported before anything is written to w.
 func Repack(w io.Writer, r io.Reader, level int) error {
-	p := NewReader(r, level)
-	_, err := io.Copy(w, p)
+	return RepackWithOptions(w, r, Options{Level: level})
+}
+
+// RepackWithOptions is like Repack, but configures
+// the conversion with the given options.
+//
+// Unless w is a *bytes.Buffer or has a Flush method, as *bufio.Writer
+// does, output is buffered to avoid many small writes to w, with a
+// buffer of Options.BufferSize.
+func RepackWithOptions(w io.Writer, r io.Reader, opts Options) error {
+	p, err := NewReaderWithOptions(r, opts)
 	if err != nil {
 		return err
 	}
-	return nil
+	defer p.Close()
+	_, err = p.copyTo(w)
+	return err
 }
 
-// Repack reads a PNG file from the given io.Reader and
-// writes it recompressed with the given level to io.Writer.
-func NewReader(r io.Reader, level int) io.Reader {
-	return &Reader{
-		r:     r,
-		level: level,
-		buf:   make([]byte, bufSize),
-		crc:   crc32.NewIEEE(),
-		zcrc:  crc32.NewIEEE(),
+// RepackContext is like Repack, but stops with the context's error
+// as soon as ctx is done.
+func RepackContext(ctx context.Context, w io.Writer, r io.Reader, level int) error {
+	p, err := NewReaderWithOptions(r, Options{Level: level})
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+	p.ctx = ctx
+	_, err = p.copyTo(w)
+	return err
+}
+
+// copyTo copies output to w, buffering it unless
+// w is already buffered, and returns the number of bytes copied.
+func (p *Reader) copyTo(w io.Writer) (int64, error) {
+	switch w.(type) {
+	case *bytes.Buffer, interface{ Flush() error }:
+		return io.Copy(w, p)
+	}
+	size := p.opts.BufferSize
+	if size <= 0 {
+		size = bufSize
+	}
+	bw := bufio.NewWriterSize(w, size)
+	n, err := io.Copy(bw, p)
+	if err == nil {
+		err = bw.Flush()
+	}
+	return n, err
+}
+
+// RepackBytes returns the PNG file src recompressed with the given level.
+func RepackBytes(src []byte, level int) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(src)))
+	if err := Repack(out, bytes.NewReader(src), level); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// Options configures a Reader.
+type Options struct {
+	// Level is the zlib compression level used for image data:
+	// zlib.NoCompression, zlib.BestSpeed through zlib.BestCompression,
+	// zlib.DefaultCompression, or zlib.HuffmanOnly, which selects
+	// the Huffman-only strategy, sometimes better for filtered
+	// photographic images.
+	Level int
+
+	// PreserveVerbatim lists ancillary chunk types that are always
+	// copied byte-for-byte, including their original CRC, bypassing
+	// any transformation that would otherwise apply to them.
+	PreserveVerbatim []string
+
+	// ChecksumDiagnostics makes checksum mismatches return an error
+	// wrapping *ChecksumError, which carries the chunk header and the
+	// first bytes of chunk data and can be retrieved with errors.As.
+	ChecksumDiagnostics bool
+
+	// IgnoreInputCRC disables verification of chunk checksums.
+	IgnoreInputCRC bool
+
+	// RecomputeOutputCRC writes checksums computed over the emitted
+	// chunk data instead of copying them from the input. Together
+	// with IgnoreInputCRC it fixes invalid checksums. Chunks listed
+	// in PreserveVerbatim keep their original checksum.
+	RecomputeOutputCRC bool
+
+	// ReadBytesPerSecond, if positive, limits the average rate at which
+	// input is consumed. Reads are paced by the number of bytes they
+	// return, so that declared chunk lengths, which may be corrupt,
+	// don't affect waiting.
+	ReadBytesPerSecond int
+
+	// SizeHint, if positive, is the total size of the input in bytes.
+	// It is used to detect chunks whose length field claims more data
+	// than is available, which would otherwise show up as an unexpected
+	// end of file once the data runs out.
+	SizeHint int64
+
+	// DropOpaqueAlpha converts gray+alpha and RGBA images whose
+	// pixels are all fully opaque to gray and RGB, respectively.
+	// Images where every non-opaque pixel is fully transparent and
+	// has the same color, which no opaque pixel has, are converted
+	// too, with a tRNS chunk marking that color as transparent.
+	//
+	// Checking pixels requires decoding the whole image, so with
+	// this option the decompressed image data is kept in memory
+	// and no output is produced until it has been processed.
+	DropOpaqueAlpha bool
+
+	// Filter selects how scanlines are filtered before compression.
+	// The default, FilterNone, keeps filters of the input image.
+	// Like DropOpaqueAlpha, other values require keeping the whole
+	// decompressed image in memory.
+	Filter FilterHeuristic
+
+	// HonorSBIT reduces the bit depth of images with an sBIT chunk
+	// declaring fewer significant bits than stored, when the unused
+	// low bits carry no information, for example, 16-bit samples that
+	// are all 8-bit values scaled up, or 8-bit gray samples that are
+	// all 4-bit values scaled up. Like DropOpaqueAlpha, this requires
+	// keeping the decompressed image in memory.
+	HonorSBIT bool
+
+	// InputPixelHash and OutputPixelHash, if set, receive decoded
+	// pixels of the input and output image, respectively, in row-major
+	// order as RGBA with 16 bits per sample, big-endian. Samples of
+	// lower bit depth are scaled to the full range, palette indexes
+	// are looked up, and transparency from tRNS is applied, so equal
+	// sums mean that transformations preserved the image. Like
+	// DropOpaqueAlpha, these require keeping the decompressed image
+	// in memory.
+	InputPixelHash  hash.Hash
+	OutputPixelHash hash.Hash
+
+	// OrderFunc, if set, controls placement of ancillary chunks that
+	// precede image data. It receives them in input order and returns
+	// chunks to write immediately before the first IDAT chunk and
+	// chunks to write immediately before IEND. Returned chunks must
+	// be ancillary; their checksums are computed anew. Omitted chunks
+	// are dropped. Of beforeIDAT chunks, those that must precede PLTE,
+	// such as gAMA, are written before it, and the others after it,
+	// each in the returned order. Returning chunks that must precede
+	// image data, such as pHYs, in afterIDAT is an error.
+	//
+	// Chunks listed in PreserveVerbatim are not passed to OrderFunc
+	// and keep their position.
+	OrderFunc func(chunks []Chunk) (beforeIDAT, afterIDAT []Chunk)
+
+	// IDATFirst moves all chunks between IHDR and image data after it.
+	// PNG requires some chunks, such as PLTE, to precede image data;
+	// if any of them is present, Read returns an error. This layout is
+	// non-standard: it is meant for constrained decoders that expect
+	// image data right after IHDR, and is not recommended otherwise.
+	IDATFirst bool
+
+	// RawDeflateIDAT writes image data as a raw deflate stream,
+	// without the zlib header and checksum. The result is NOT a valid
+	// PNG file: this is only useful for custom formats that store
+	// PNG chunks with raw deflate data.
+	RawDeflateIDAT bool
+
+	// CoalesceIDAT writes all image data as a single IDAT chunk.
+	// Since the chunk length precedes its data, the whole compressed
+	// image is kept in memory until it is written, instead of being
+	// streamed in 32K chunks.
+	CoalesceIDAT bool
+
+	// IDATSize, if positive, is the maximum data length of IDAT and
+	// fdAT chunks written, otherwise 32768 bytes. Every chunk but the
+	// last of an image has this length. It must be greater than 4,
+	// the length of the fdAT sequence number, and cannot be combined
+	// with CoalesceIDAT or PreserveIDATLayout.
+	IDATSize int
+
+	// KeepSmaller writes the original image data instead of the
+	// recompressed data if its chunks, in the input layout, are not
+	// larger. Both are kept in memory until the end of image data.
+	// Likewise, the original compressed data of zTXt, iTXt, and iCCP
+	// chunks is kept if it is not larger, as are APNG frames, which
+	// never grow. Thus the output is not larger than the input, except
+	// for chunks added with InsertChunks or SetDPI, original data split
+	// to follow IDATSize, and image data that cannot be kept: if pixel
+	// transformations changed IHDR, or with RawDeflateIDAT, Dict, or
+	// WindowBits, which change the stream format. Use MaxGrowthFactor
+	// for a guarantee that holds regardless of options.
+	KeepSmaller bool
+
+	// SkipIfNotBeneficial is like KeepSmaller, but also stops
+	// recompressing image data as soon as the recompressed data
+	// exceeds the original data read so far, which suggests that the
+	// input is already compressed at least as well, and then keeps the
+	// original. This saves work on such files, but, being a guess, may
+	// occasionally keep the original where recompression would have
+	// made it slightly smaller in the end. Without the short cut, the
+	// decision requires a full recompression. Image data being
+	// transformed by pixel options is always recompressed in full.
+	SkipIfNotBeneficial bool
+
+	// PreserveIDATLayout splits output image data into IDAT chunks of
+	// the same lengths as in the input. This reproduces the input
+	// layout only if the recompressed data has the same length, for
+	// example, when the input was written with the same level and
+	// compressor. Otherwise, if the data is shorter, there are fewer
+	// chunks or the last one is shorter, and if it is longer, the
+	// excess is written in additional chunks of up to 32K at the end
+	// of image data. It cannot be combined with CoalesceIDAT.
+	PreserveIDATLayout bool
+
+	// OnChunk, if set, is called with the type and data length of each
+	// chunk after it has been read and verified, except for image data,
+	// for which it is called with the length of each IDAT chunk written
+	// instead. It is called from Read, must be cheap, and must not call
+	// methods of the Reader.
+	OnChunk func(chunkType string, compressedLen int)
+
+	// OnEXIFThumbnail, if set, is called with the JPEG thumbnail
+	// embedded in the eXIf chunk, if there is one.
+	OnEXIFThumbnail func(jpeg []byte)
+
+	// StripEXIF drops eXIf chunks.
+	StripEXIF bool
+
+	// MaxGrowthFactor, if positive, limits the size of output relative
+	// to input: if the result is larger than the input size multiplied
+	// by the factor, the original file is returned instead. For example,
+	// 1 guarantees that the output is never larger than the input.
+	//
+	// This requires keeping both the whole input and output in memory,
+	// and no output is produced until the input is fully processed.
+	MaxGrowthFactor float64
+
+	// KeepChunk, if set, is called with the type of each ancillary
+	// chunk to decide whether to keep it. Chunks for which it returns
+	// false are read and verified, but not written to the output.
+	// Critical chunks and chunks listed in PreserveVerbatim are always
+	// kept. StripChunks and KeepOnlyChunks return functions for
+	// deny and allow lists of types.
+	KeepChunk func(chunkType string) bool
+
+	// KeepScientificChunks protects the extension chunks used by
+	// scientific imagery, oFFs, pCAL, and sCAL, from every option
+	// that would drop or transform them, as if they were listed
+	// in PreserveVerbatim.
+	KeepScientificChunks bool
+
+	// ValidateSCAL verifies the structure of sCAL chunks: a unit
+	// specifier followed by two positive floating-point numbers
+	// separated by a null byte.
+	ValidateSCAL bool
+
+	// Repair fixes known defects of input files instead of returning
+	// an error: invalid checksums are replaced with correct ones, even
+	// for chunks listed in PreserveVerbatim, IHDR chunks with up to
+	// 4 bytes of trailing padding covered by their checksum are
+	// truncated to the standard 13 bytes,
+	// and ancillary chunks interrupting image data are moved out of it,
+	// before it if they must precede image data, otherwise after it.
+	// Such chunks are processed as any other, for example, subject to
+	// KeepChunk. Because they may appear anywhere in image data, it is
+	// read up to the next critical chunk before it is decompressed, and
+	// kept in memory until complete, as with CoalesceIDAT.
+	Repair bool
+
+	// BufferSize is the size of the buffer used to copy chunk data
+	// and decompressed image data, 32768 bytes if zero or negative.
+	// Small buffers work, but increase the number of reads from
+	// the underlying reader. It doesn't affect the size of IDAT
+	// chunks written to the output.
+	BufferSize int
+
+	// Compressor, if set, compresses image data, APNG frames, and
+	// the compressed chunks recompressed by this package instead of
+	// the built-in zlib writer; Level doesn't apply to it. With
+	// RawDeflateIDAT, it is only used for image data, and the data
+	// of other chunks is kept as it is.
+	Compressor Compressor
+
+	// Dict is a preset dictionary for compressing image data.
+	// The result is NOT a valid PNG file: its image data can only be
+	// decompressed with the same dictionary, for example, with
+	// zlib.NewReaderDict. Dict cannot be combined with Compressor.
+	Dict []byte
+
+	// WindowBits, if between 8 and 14, sets the base-two logarithm of
+	// the window size declared in the zlib header of image data,
+	// letting decoders allocate less memory. The default is 15, the
+	// 32K window. Since the package's compressor always uses the full
+	// window, a smaller one is only honored by giving up matching of
+	// repeated strings: image data is stored with NoCompression and
+	// Huffman-coded with all other levels, so it's usually larger.
+	// WindowBits cannot be combined with Compressor or Dict.
+	WindowBits int
+
+	// Strategy selects the deflate strategy for image data. The
+	// default, StrategyDefault, is set by Level. compress/flate has no
+	// filtered or run-length strategies, so other strategies of zlib
+	// are only available through a Compressor. Strategy cannot be
+	// combined with Compressor or Dict.
+	Strategy Strategy
+
+	// MaxDecompressedSize, if positive, limits the total size of
+	// decompressed data of all zlib streams in the file, including
+	// image data and compressed ancillary chunks. Exceeding it
+	// returns ErrDecompressedTooLarge.
+	MaxDecompressedSize int64
+
+	// MaxChunks, if positive, limits the number of chunks in the file,
+	// including IDAT chunks. Exceeding it returns ErrTooManyChunks.
+	MaxChunks int
+
+	// RequireIEND makes the file structure checked to its end: IEND
+	// must be empty and nothing may follow it. Input ending before IEND
+	// is reported as ErrMissingIEND with or without it, except with
+	// NewChunkReader, which only requires IEND with this option.
+	RequireIEND bool
+
+	// InsertChunks lists ancillary chunks to add to the output, with
+	// lengths and checksums computed for them. Chunks of types that
+	// must precede image data, such as pHYs, are inserted before the
+	// first IDAT chunk; others, such as tEXt, before IEND. Inserted
+	// chunks are not subject to KeepChunk, but are passed to OrderFunc
+	// if they precede image data.
+	InsertChunks []Chunk
+
+	// MaxOutputSize, if positive, limits the size of output: Read
+	// returns ErrOutputTooLarge as soon as the output produced exceeds
+	// it, and processing is aborted. With MaxGrowthFactor, the limit
+	// applies to the output chosen at the end of input.
+	MaxOutputSize int64
+
+	// Pipeline decompresses image data in a separate goroutine, so that
+	// it runs concurrently with compression. The output is the same.
+	// Input is still read and chunks are processed on the goroutine
+	// calling Read; up to two buffers each of compressed and
+	// decompressed data are in flight.
+	Pipeline bool
+
+	// Canonicalize reorders chunks as recommended by the PNG
+	// specification: IHDR, ancillary chunks that must precede PLTE,
+	// PLTE, other chunks that must precede image data, image data, and
+	// the remaining ancillary chunks, such as text, before IEND. The
+	// input order is kept within each group. Unknown critical chunks and
+	// chunks listed in PreserveVerbatim stay after the chunk preceding
+	// them in the input. The whole output is kept in memory until IEND.
+	// It cannot be combined with OrderFunc or IDATFirst.
+	Canonicalize bool
+
+	// StripAnimation removes acTL, fcTL, and fdAT chunks, turning an
+	// APNG file into a static PNG file with its default image, which
+	// is stored in IDAT whether or not it is the first frame.
+	StripAnimation bool
+
+	// SetDPI, if positive, sets the physical resolution of the image
+	// to the given number of pixels per inch in both directions,
+	// replacing pHYs chunks of the input with one written before image
+	// data. PNG stores the resolution in pixels per meter, so the value
+	// is rounded. It cannot be combined with pHYs in PreserveVerbatim.
+	SetDPI float64
+
+	// ChunkSink, if set, receives output chunks instead of Read: it is
+	// called with the type, data, and checksum of each chunk once it is
+	// complete, and Read returns no data. Data is only valid during the
+	// call. If ChunkSink returns an error, Read returns it. The PNG
+	// signature is not passed to ChunkSink. It cannot be combined with
+	// MaxGrowthFactor.
+	ChunkSink func(chunkType string, data []byte, crc uint32) error
+
+	// Dedup removes ancillary chunks that are exact copies, in type and
+	// data, of an earlier chunk, such as a repeated sRGB or tEXt chunk.
+	// Chunks that differ in data are kept even if their type may only
+	// appear once. Animation chunks and chunks in PreserveVerbatim are
+	// not affected.
+	Dedup bool
+
+	// CRCTable, if set, is the table used to compute and verify chunk
+	// checksums instead of the IEEE table required by PNG, for formats
+	// with the same chunk structure but a different checksum. Functions
+	// that take no options, such as ReadIHDR and ListChunks, always use
+	// the IEEE table.
+	CRCTable *crc32.Table
+
+	// CompressText converts tEXt chunks to zTXt chunks with the same
+	// keyword and text compressed at Level, if that makes them smaller.
+	// It doesn't apply if tEXt is in PreserveVerbatim.
+	CompressText bool
+}
+
+// Compressor creates writers that compress image data.
+//
+// Since PNG image data is a zlib stream, writers must produce one,
+// with the zlib header and Adler-32 checksum, unless RawDeflateIDAT
+// is also set. The output is not verified.
+type Compressor interface {
+	// NewWriter returns a writer compressing data to w.
+	// Close must flush all compressed data to w.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+}
+
+// CompressorFunc adapts a function to the Compressor interface,
+// for example, to use a zlib writer from another package:
+//
+//	opts.Compressor = pnglevel.CompressorFunc(func(w io.Writer) (io.WriteCloser, error) {
+//		return zlib.NewWriterLevel(w, zlib.BestCompression)
+//	})
+type CompressorFunc func(w io.Writer) (io.WriteCloser, error)
+
+// NewWriter returns f(w).
+func (f CompressorFunc) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return f(w)
+}
+
+// scientificChunks are protected by KeepScientificChunks.
+var scientificChunks = []string{"oFFs", "pCAL", "sCAL"}
+
+// diagDataLen is the number of chunk data bytes retained for
+// ChecksumError.
+const diagDataLen = 16
+
+// ChecksumError describes a chunk whose stored CRC doesn't match
+// its contents. It is returned when Options.ChecksumDiagnostics is set.
+type ChecksumError struct {
+	ChunkType string
+	Header    []byte // chunk length and type
+	Data      []byte // first bytes of chunk data
+	Stored    uint32
+	Computed  uint32
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("pnglevel: invalid checksum of %s chunk: stored %08x, computed %08x, header [% x], data [% x]",
+		e.ChunkType, e.Stored, e.Computed, e.Header, e.Data)
+}
+
+// Unwrap returns ErrBadChecksum.
+func (e *ChecksumError) Unwrap() error {
+	return ErrBadChecksum
+}
+
+// Error describes where processing of a PNG file failed.
+// Read returns errors caused by the input wrapped in it.
+type Error struct {
+	ChunkType string // type of the current chunk, empty if between chunks
+	Offset    int64  // number of input bytes read when the error occurred
+	Err       error
+}
+
+func (e *Error) Error() string {
+	if e.ChunkType == "" {
+		return fmt.Sprintf("%v (offset %d)", e.Err, e.Offset)
+	}
+	return fmt.Sprintf("%v (%s chunk, offset %d)", e.Err, e.ChunkType, e.Offset)
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrTruncated and e describes truncated input.
+func (e *Error) Is(target error) bool {
+	return target == ErrTruncated && (e.Err == io.ErrUnexpectedEOF || e.Err == ErrMissingIEND)
+}
+
+// NewReader returns a Reader that reads a PNG file from r and
+// returns it recompressed with the given level.
+// An invalid level is only reported by Read when it reaches image data;
+// NewReaderWithOptions reports it immediately.
+func NewReader(r io.Reader, level int) *Reader {
+	return newReader(r, Options{Level: level})
+}
+
+func newReader(r io.Reader, opts Options) *Reader {
+	p := new(Reader)
+	p.reset(r, opts)
+	return p
+}
+
+// Reset discards the state of p and makes it recompress the PNG file
+// read from r with the given level, keeping other options and reusing
+// allocated buffers and zlib state. It allows a Reader to be reused,
+// avoiding most allocations per file, for example,
+// with sync.Pool:
+//
+//	var readers = sync.Pool{New: func() interface{} { return pnglevel.NewReader(nil, 0) }}
+//
+//	func repack(w io.Writer, r io.Reader, level int) error {
+//		p := readers.Get().(*pnglevel.Reader)
+//		defer readers.Put(p)
+//		p.Reset(r, level)
+//		_, err := io.Copy(w, p)
+//		return err
+//	}
+func (p *Reader) Reset(r io.Reader, level int) {
+	opts := p.opts
+	opts.Level = level
+	stage := p.start
+	p.reset(r, opts)
+	p.stage, p.start = stage, stage
+}
+
+// reset initializes p, reusing its buffers.
+func (p *Reader) reset(r io.Reader, opts Options) {
+	if p.stage == stIDAT {
+		// Stop decompression, which may be running in a goroutine
+		// with Pipeline, before its state is reused.
+		p.Abort()
+	}
+	size := opts.BufferSize
+	if size <= 0 {
+		size = bufSize
+	}
+	buf, crc := p.buf, p.crc
+	if cap(buf) < size {
+		buf = make([]byte, size)
+	}
+	if crc == nil || opts.CRCTable != p.opts.CRCTable {
+		tab := opts.CRCTable
+		if tab == nil {
+			tab = crc32.IEEETable
+		}
+		crc = crc32.New(tab)
+	}
+	w, zbuf, frame, verbatim := p.w, p.zbuf, p.frame, p.verbatim
+	zlibR, zlibW, zlibLevel := p.zlibR, p.zlibW, p.zlibLevel
+	w.Reset()
+	zbuf.Reset()
+	*p = Reader{
+		opts:     opts,
+		verbatim: verbatim,
+		w:        w,
+		zbuf:     zbuf,
+		frame:    frame[:0],
+		buf:      buf[:size],
+		crc:      crc,
+
+		zlibR:     zlibR,
+		zlibW:     zlibW,
+		zlibLevel: zlibLevel,
+	}
+	p.in.r = r
+	if opts.MaxGrowthFactor > 0 {
+		p.orig = new(bytes.Buffer)
+		p.in.r = io.TeeReader(r, p.orig)
+	}
+	p.r = &p.in
+	if opts.SetDPI > 0 {
+		p.inserts = append(p.inserts, newChunk("pHYs", physData(opts.SetDPI), p.crcTable()))
+	}
+	for _, c := range opts.InsertChunks {
+		if beforeIDAT[c.Type] {
+			p.inserts = append(p.inserts, newChunk(c.Type, c.Data, p.crcTable()))
+		} else {
+			p.trailer = append(p.trailer, newChunk(c.Type, c.Data, p.crcTable()))
+		}
+	}
+	sameFormat := !opts.RawDeflateIDAT && len(opts.Dict) == 0 && (opts.WindowBits == 0 || opts.WindowBits == 15)
+	if (opts.KeepSmaller || opts.SkipIfNotBeneficial) && sameFormat {
+		p.origIDAT = new(bytes.Buffer)
+	}
+	if opts.ReadBytesPerSecond > 0 {
+		p.r = &pacedReader{p: p, pc: pacer{rate: float64(opts.ReadBytesPerSecond)}}
 	}
+	p.pixels = opts.DropOpaqueAlpha || opts.Filter != FilterNone || opts.HonorSBIT ||
+		opts.InputPixelHash != nil || opts.OutputPixelHash != nil
+	// Pixel transformations may change chunks preceding image data,
+	// so hold output until it is processed.
+	p.hold = p.pixels || opts.OrderFunc != nil || opts.IDATFirst || opts.Canonicalize
 }
 
-func (p *Reader) Read(b []byte) (nn int, err error) {
-	for p.w.Len() == 0 {
+// NewReaderWithOptions is like NewReader, but configured with opts.
+func NewReaderWithOptions(r io.Reader, opts Options) (*Reader, error) {
+	if opts.Level < zlib.HuffmanOnly || opts.Level > zlib.BestCompression {
+		return nil, fmt.Errorf("pnglevel: invalid compression level %d", opts.Level)
+	}
+	if opts.WindowBits != 0 && (opts.WindowBits < 8 || opts.WindowBits > 15) {
+		return nil, fmt.Errorf("pnglevel: invalid window bits %d", opts.WindowBits)
+	}
+	if opts.WindowBits != 0 && opts.WindowBits != 15 && (opts.Compressor != nil || len(opts.Dict) > 0) {
+		return nil, errors.New("pnglevel: window bits cannot be used with custom compressor or dictionary")
+	}
+	if len(opts.Dict) > 0 && opts.Compressor != nil {
+		return nil, errors.New("pnglevel: dictionary cannot be used with custom compressor")
+	}
+	if opts.Strategy < StrategyDefault || opts.Strategy > StrategyHuffmanOnly {
+		return nil, errors.New("pnglevel: unknown strategy")
+	}
+	if opts.Strategy != StrategyDefault && (opts.Compressor != nil || len(opts.Dict) > 0) {
+		return nil, errors.New("pnglevel: strategy cannot be used with custom compressor or dictionary")
+	}
+	if opts.ChunkSink != nil && opts.MaxGrowthFactor > 0 {
+		return nil, errors.New("pnglevel: ChunkSink cannot be used with MaxGrowthFactor")
+	}
+	if opts.MaxGrowthFactor < 0 {
+		return nil, errors.New("pnglevel: negative growth factor")
+	}
+	if opts.Filter < FilterNone || opts.Filter > FilterBruteForce {
+		return nil, errors.New("pnglevel: unknown filter heuristic")
+	}
+	if opts.Canonicalize && (opts.OrderFunc != nil || opts.IDATFirst) {
+		return nil, errors.New("pnglevel: Canonicalize cannot be used with OrderFunc or IDATFirst")
+	}
+	if opts.PreserveIDATLayout && opts.CoalesceIDAT {
+		return nil, errors.New("pnglevel: PreserveIDATLayout cannot be used with CoalesceIDAT")
+	}
+	if opts.IDATSize > 0 && (opts.IDATSize <= 4 || opts.IDATSize > maxChunkLen) {
+		return nil, errors.New("pnglevel: invalid IDAT size")
+	}
+	if opts.IDATSize > 0 && (opts.CoalesceIDAT || opts.PreserveIDATLayout) {
+		return nil, errors.New("pnglevel: IDATSize cannot be used with CoalesceIDAT or PreserveIDATLayout")
+	}
+	if opts.SetDPI < 0 || math.IsNaN(opts.SetDPI) || math.Round(opts.SetDPI/0.0254) > math.MaxInt32 {
+		return nil, errors.New("pnglevel: invalid DPI")
+	}
+	for _, c := range opts.InsertChunks {
+		if !isAncillaryType(c.Type) {
+			return nil, fmt.Errorf("pnglevel: cannot insert chunk of type %q", c.Type)
+		}
+	}
+	p := newReader(r, opts)
+	verbatim := opts.PreserveVerbatim
+	if opts.KeepScientificChunks {
+		verbatim = append(verbatim[:len(verbatim):len(verbatim)], scientificChunks...)
+	}
+	for _, kind := range verbatim {
+		if kind == "pHYs" && opts.SetDPI != 0 {
+			return nil, errors.New("pnglevel: pHYs cannot be preserved verbatim with SetDPI")
+		}
+		if len(kind) != 4 {
+			return nil, fmt.Errorf("pnglevel: invalid chunk type %q", kind)
+		}
+		if isCritical(kind) {
+			return nil, fmt.Errorf("pnglevel: critical chunk %s cannot be preserved verbatim", kind)
+		}
+		if p.verbatim == nil {
+			p.verbatim = make(map[string]bool)
+		}
+		p.verbatim[kind] = true
+	}
+	return p, nil
+}
+
+// NewChunkReader is like NewReaderWithOptions, but for assembling a PNG
+// file piece by piece: it reads a sequence of chunks that follow IHDR,
+// such as image data and IEND, and returns them with image data
+// recompressed, without the PNG signature.
+//
+// The caller is responsible for providing input that starts at a chunk
+// boundary after IHDR, and for writing the signature, IHDR, and any
+// other chunks that precede it to the output. Since IHDR is not seen,
+// options that depend on it or rearrange chunks, such as pixel
+// transformations and OrderFunc, are rejected.
+func NewChunkReader(r io.Reader, opts Options) (*Reader, error) {
+	p, err := NewReaderWithOptions(r, opts)
+	if err != nil {
+		return nil, err
+	}
+	if p.hold {
+		return nil, errors.New("pnglevel: options require IHDR")
+	}
+	p.stage, p.start = stChunkHead, stChunkHead
+	return p, nil
+}
+
+func (p *Reader) Read(b []byte) (int, error) {
+	if err := p.fill(); err != nil {
+		return 0, err
+	}
+	n, err := p.w.Read(b[:min(len(b), p.w.Len())])
+	p.out += int64(n)
+	return n, err
+}
+
+// WriteTo implements io.WriterTo, writing output directly to w
+// until there is no more of it or an error occurs.
+func (p *Reader) WriteTo(w io.Writer) (n int64, err error) {
+	for {
+		if err := p.fill(); err != nil {
+			if err == io.EOF {
+				return n, nil
+			}
+			return n, err
+		}
+		m, err := p.w.WriteTo(w)
+		n += m
+		p.out += m
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+// Counts returns the number of bytes read from the underlying reader
+// and the number of bytes of output returned, or passed to ChunkSink,
+// so far.
+func (p *Reader) Counts() (in, out int64) {
+	return p.in.n, p.out
+}
+
+// fill processes input until output is ready to be consumed.
+// It returns io.EOF when there is no more output.
+func (p *Reader) fill() error {
+	if p.aborted {
+		return ErrAborted
+	}
+	for p.w.Len() == 0 || p.hold || p.orig != nil || p.opts.ChunkSink != nil {
 		if p.eof {
-			return 0, io.EOF
+			p.hold = false
+			if p.orig != nil {
+				p.limitGrowth()
+				if err := p.checkOutputSize(); err != nil {
+					return err
+				}
+			}
+			if err := p.sinkChunks(); err != nil {
+				return err
+			}
+			if p.w.Len() == 0 {
+				return io.EOF
+			}
+			break
+		}
+		if p.ctx != nil {
+			if err := p.ctx.Err(); err != nil {
+				return err
+			}
 		}
 		if err := p.refill(); err != nil {
 			if err == io.EOF {
 				p.eof = true
 				continue
 			}
-			return 0, err
+			return p.errorAt(err)
+		}
+		if p.orig == nil {
+			if err := p.checkOutputSize(); err != nil {
+				return err
+			}
+		}
+		if !p.hold {
+			if err := p.sinkChunks(); err != nil {
+				return err
+			}
 		}
 	}
-	n, err := p.w.Read(b[:min(len(b), p.w.Len())])
-	return n, err
+	return nil
+}
+
+// errorAt wraps err in *Error describing the current position.
+func (p *Reader) errorAt(err error) error {
+	return &Error{ChunkType: p.chunkType, Offset: p.in.n, Err: err}
+}
+
+// checkOutputSize enforces MaxOutputSize on output returned and
+// pending, aborting processing if it is exceeded.
+func (p *Reader) checkOutputSize() error {
+	if max := p.opts.MaxOutputSize; max > 0 && p.out+int64(p.w.Len()) > max {
+		p.Abort()
+		return ErrOutputTooLarge
+	}
+	return nil
+}
+
+// limitGrowth replaces output with the original input if it
+// exceeds MaxGrowthFactor.
+func (p *Reader) limitGrowth() {
+	if float64(p.w.Len()) > float64(p.orig.Len())*p.opts.MaxGrowthFactor {
+		p.w.Reset()
+		p.w.Write(p.orig.Bytes())
+	}
+	p.orig = nil
+}
+
+// Abort stops processing, releasing zlib state and discarding any
+// pending output. The underlying reader is left positioned wherever
+// processing stopped, which is not necessarily at its end.
+// Subsequent calls to Read return ErrAborted.
+func (p *Reader) Abort() {
+	if p.aborted {
+		return
+	}
+	if p.stage == stIDAT {
+		p.zr.Close()
+		if p.zw != nil {
+			p.zw.Close()
+		}
+	}
+	p.zr = nil
+	p.zw = nil
+	p.w.Reset()
+	p.zbuf.Reset()
+	p.aborted = true
+}
+
+// Close releases resources held by p, including zlib state if it
+// is closed while processing image data. Subsequent calls to Read
+// return ErrAborted. The underlying reader is not closed.
+// A closed Reader may be reused by calling Reset.
+func (p *Reader) Close() error {
+	p.Abort()
+	p.w = bytes.Buffer{}
+	p.zbuf = bytes.Buffer{}
+	p.buf = nil
+	p.frame = nil
+	p.zlibR = nil
+	p.zlibW = nil
+	return nil
 }
 
 func (p *Reader) refill() error {
@@ -92,12 +964,31 @@ func (p *Reader) refill() error {
 		}
 		p.stage = stChunkHead
 	case stChunkHead:
+		if p.sawIEND && p.opts.RequireIEND {
+			// Nothing may follow IEND.
+			_, err := io.ReadFull(p.r, p.tmp[:1])
+			if err == nil {
+				return errors.New("pnglevel: data after IEND")
+			}
+			return err
+		}
+		p.chunkType = ""
 		length, kind, err := p.chunkHeader()
 		if err != nil {
+			if err == io.EOF && p.opts.RequireIEND && !p.sawIEND {
+				return ErrMissingIEND
+			}
+			if err == io.EOF && !p.processedIDAT && p.start == stStart {
+				// The file ended before image data.
+				return io.ErrUnexpectedEOF
+			}
+			if err == io.EOF && !p.sawIEND && p.start == stStart {
+				return ErrMissingIEND
+			}
 			return err
 		}
 		if length > maxChunkLen {
-			return errors.New("pnglevel: chunk is too big")
+			return ErrChunkTooBig
 		}
 		p.chunkLen = length
 		p.chunkType = kind
@@ -118,21 +1009,32 @@ func (p *Reader) refill() error {
 				if !p.readNonIDAT {
 					// Verify checksum of last IDAT chunk without writing it.
 					if _, err := io.ReadFull(p.r, p.tmp[:4]); err != nil {
+						if err == io.EOF {
+							err = io.ErrUnexpectedEOF
+						}
 						return err
 					}
-					if binary.BigEndian.Uint32(p.tmp[:4]) != p.crc.Sum32() {
-						return fmt.Errorf("pnglevel: invalid checksum of IDAT chunk")
+					if err := p.checkCrc(binary.BigEndian.Uint32(p.tmp[:4])); err != nil {
+						return err
 					}
 					p.stage = stChunkHead
 					return nil
 				}
+				// The header of the chunk following image data
+				// has been read by idatReader.
+				if err := p.beginChunk(p.chunkLen, string(p.head[4:8])); err != nil {
+					return err
+				}
 				p.stage = stChunkData
 				return nil
 			}
 			return err
 		}
 	default:
-		panic("pnglevel: programmer error, unknown stage")
+		// Stages are only set by the Reader itself, but report
+		// rather than panic so that a bug cannot crash a caller
+		// processing untrusted input.
+		return errors.New("pnglevel: internal error, unknown stage")
 	}
 	return nil
 }
@@ -140,41 +1042,84 @@ func (p *Reader) refill() error {
 func (p *Reader) handleChunkData() (err error) {
 	if p.chunkType == "IDAT" {
 		if p.processedIDAT {
-			return errors.New("pnglevel: wrong IDAT order")
+			return ErrWrongIDATOrder
 		}
-		p.zr, err = zlib.NewReader(&idatReader{r: p})
-		if err != nil {
-			return err
+		// Count the chunk before the zlib reader consumes it.
+		p.idatIn += int64(p.chunkLen)
+		var src io.Reader = &idatReader{r: p}
+		if p.opts.Repair {
+			if src, err = p.gatherIDAT(); err != nil {
+				return err
+			}
 		}
-		p.zw, err = zlib.NewWriterLevel(&p.zbuf, p.level)
-		if err != nil {
+		if p.opts.Pipeline {
+			p.zr = newPipelineReader(src, len(p.buf))
+		} else if p.zr, err = p.newDecompressor(src); err != nil {
 			return err
 		}
+		p.zr = &inflateLimiter{p.zr, p}
+		if p.ctx != nil {
+			// Image data may be decompressed in a single refill.
+			p.zr = &contextReader{p.zr, p.ctx}
+		}
+		if p.sink == nil && !p.skipIDAT {
+			p.zw, err = p.newCompressor()
+			if err != nil {
+				return err
+			}
+		}
+		p.writeInserts()
+		if p.hold && !p.pixels {
+			if err := p.writeHeld(p.heldChunks()); err != nil {
+				return err
+			}
+		}
 		p.processedIDAT = true
 		p.stage = stIDAT
 		return nil
 	}
-	// Read and chunk write data.
+	if p.whole(p.chunkType) {
+		return p.handleWholeChunk()
+	}
+	// Read and write chunk data. Chunks listed in PreserveVerbatim
+	// take this path unconditionally.
+	// Use any data returned along with an error.
 	n, err := p.r.Read(p.buf[:min(len(p.buf), p.chunkLen)])
-	if err != nil {
-		return err
+	if !p.skip {
+		p.w.Write(p.buf[:n])
 	}
-	p.w.Write(p.buf[:n])
 	p.crc.Write(p.buf[:n])
-	p.chunkLen -= int(n)
+	p.retain(p.buf[:n])
+	p.chunkLen -= n
 	if p.chunkLen == 0 {
 		p.stage = stChunkCrc
 	}
+	if err == io.EOF && p.chunkLen > 0 {
+		return io.ErrUnexpectedEOF
+	}
+	if err != io.EOF {
+		return err
+	}
 	return nil
 }
 
+// verifyHeader reads and verifies the PNG signature and IHDR.
 func (p *Reader) verifyHeader() error {
+	err := p.readHeader()
+	if err == io.EOF {
+		// The file ended before IHDR was complete.
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (p *Reader) readHeader() error {
 	// Verify PNG file signature.
 	if _, err := io.ReadFull(p.r, p.tmp[:8]); err != nil {
 		return err
 	}
 	if string(p.tmp[:8]) != pngHeader {
-		return errors.New("pnglevel: not a PNG file")
+		return ErrNotPNG
 	}
 	if _, err := p.w.Write(p.tmp[:8]); err != nil {
 		return err
@@ -185,100 +1130,641 @@ func (p *Reader) verifyHeader() error {
 	if err != nil {
 		return err
 	}
+	if kind == "CgBI" {
+		return ErrAppleCgBI
+	}
 	if kind != "IHDR" {
-		return errors.New("pnglevel: missing IHDR")
+		return ErrMissingIHDR
 	}
-	if length != 13 {
-		return errors.New("pnglevel: incorrect IHDR length")
+	padding := length - 13
+	if padding != 0 && (!p.opts.Repair || padding < 0 || padding > maxIHDRPadding) {
+		return ErrBadIHDRLength
 	}
 	if _, err := io.ReadFull(p.r, p.tmp[:13]); err != nil {
 		return err
 	}
 	if p.tmp[10] != 0 {
-		return errors.New("pnglevel: unsupported compression method")
+		return ErrUnsupportedCompression
+	}
+	if p.tmp[11] != 0 {
+		return errors.New("pnglevel: unsupported filter method")
+	}
+	p.hdr = parseIHDR(p.tmp[:13])
+	if p.pixels {
+		if err := p.hdr.validate(); err != nil {
+			return err
+		}
 	}
 	p.crc.Write(p.tmp[:13])
+	p.retain(p.tmp[:13])
 	if _, err := p.w.Write(p.tmp[:13]); err != nil {
 		return err
 	}
-	if err := p.verifyCrc(); err != nil {
+	if padding > 0 {
+		if err := p.dropIHDRPadding(padding); err != nil {
+			return err
+		}
+	} else if err := p.verifyCrc(); err != nil {
+		return err
+	}
+	p.haveHdr = true
+	return nil
+}
+
+// dropIHDRPadding reads padding following IHDR data and its checksum,
+// which must cover the padding to show that the declared length is
+// what the encoder meant, and writes IHDR without the padding.
+func (p *Reader) dropIHDRPadding(padding int) error {
+	var pad [maxIHDRPadding]byte
+	if _, err := io.ReadFull(p.r, pad[:padding]); err != nil {
+		return err
+	}
+	p.crc.Write(pad[:padding])
+	if _, err := io.ReadFull(p.r, p.tmp[:4]); err != nil {
 		return err
 	}
+	if binary.BigEndian.Uint32(p.tmp[:4]) != p.crc.Sum32() && !p.opts.IgnoreInputCRC {
+		return fmt.Errorf("%w: checksum doesn't cover padding", ErrBadIHDRLength)
+	}
+	// Fix the length written by chunkHeader.
+	binary.BigEndian.PutUint32(p.w.Bytes()[8:], 13)
+	binary.BigEndian.PutUint32(p.tmp[:4], chunkCRC(p.crcTable(), "IHDR", p.hdr.bytes()))
+	p.w.Write(p.tmp[:4])
+	p.chunkSize = 13
+	p.chunkDone("IHDR", 13)
+	p.crc.Reset()
 	return nil
 }
 
 func (p *Reader) chunkHeader() (length int, kind string, err error) {
-	if _, err := io.ReadFull(p.r, p.tmp[:8]); err != nil {
+	if _, err := io.ReadFull(p.r, p.head[:]); err != nil {
+		return 0, "", err
+	}
+	if length, kind, err = p.parseHeader(); err != nil {
+		return 0, "", err
+	}
+	if err := p.beginChunk(length, kind); err != nil {
 		return 0, "", err
 	}
-	ulen := binary.BigEndian.Uint32(p.tmp[:4])
+	return length, kind, nil
+}
+
+// parseHeader returns the length and type of the chunk
+// whose header is in p.head, verifying the length.
+func (p *Reader) parseHeader() (length int, kind string, err error) {
+	ulen := binary.BigEndian.Uint32(p.head[:4])
 	if ulen > maxChunkLen {
-		return 0, "", errors.New("pnglevel: chunk is too big")
+		return 0, "", ErrChunkTooBig
 	}
 	length = int(ulen)
-	kind = string(p.tmp[4:8])
-	if kind != "IDAT" {
-		// Write chunk header.
-		p.w.Write(p.tmp[:8])
+	if err := p.checkLength(length); err != nil {
+		return 0, "", err
 	}
+	return length, string(p.head[4:8]), nil
+}
+
+// beginChunk starts processing of the chunk whose header is in p.head,
+// writing pending output that precedes it and, unless the chunk is
+// processed differently, its header.
+func (p *Reader) beginChunk(length int, kind string) error {
+	if kind == "CgBI" && !p.processedIDAT {
+		return ErrAppleCgBI
+	}
+	if kind != "fdAT" {
+		if err := p.writeFrame(); err != nil {
+			return err
+		}
+	}
+	if kind == "IEND" {
+		if p.opts.RequireIEND && length != 0 {
+			return errors.New("pnglevel: invalid IEND chunk")
+		}
+		if !p.processedIDAT && p.start == stStart {
+			return ErrNoImageData
+		}
+		p.sawIEND = true
+		p.writeInserts()
+		if p.hold {
+			if err := p.writeHeld(p.heldChunks()); err != nil {
+				return err
+			}
+		}
+		p.writeTrailer()
+	}
+	p.startChunk(kind, length)
+	if kind != "IDAT" && !p.whole(kind) && !p.skip {
+		p.w.Write(p.head[:])
+	}
+	return nil
+}
+
+// checkLength verifies that the chunk data of the given length
+// and its checksum fit into the remaining input, if its size is known.
+// It also enforces MaxChunks.
+func (p *Reader) checkLength(length int) error {
+	if p.opts.MaxChunks > 0 && p.chunks >= p.opts.MaxChunks {
+		return ErrTooManyChunks
+	}
+	if p.opts.SizeHint > 0 && int64(length)+4 > p.opts.SizeHint-p.in.n {
+		return errors.New("pnglevel: chunk length exceeds available data")
+	}
+	return nil
+}
+
+// startChunk resets checksum state for a new chunk whose header
+// is in p.head.
+func (p *Reader) startChunk(kind string, length int) {
+	p.chunkType = kind
+	p.chunkSize = length
+	p.chunks++
+	if kind == "IDAT" && p.opts.PreserveIDATLayout {
+		p.idatLayout = append(p.idatLayout, length)
+	}
+	if kind == "IDAT" && p.origIDAT != nil {
+		p.origLayout = append(p.origLayout, length)
+	}
+	p.skip = p.drop(kind)
 	p.crc.Reset()
-	p.crc.Write(p.tmp[4:8])
-	return
+	p.crc.Write(p.head[4:8])
+	if p.opts.ChecksumDiagnostics {
+		copy(p.diagHead[:], p.head[:])
+		p.diagData = p.diagData[:0]
+	}
+}
+
+// chunkDone reports a processed chunk to OnChunk.
+func (p *Reader) chunkDone(kind string, length int) {
+	if p.opts.OnChunk != nil {
+		p.opts.OnChunk(kind, length)
+	}
+}
+
+// retain keeps the first bytes of chunk data for diagnostics.
+func (p *Reader) retain(b []byte) {
+	if p.opts.ChecksumDiagnostics && len(p.diagData) < diagDataLen {
+		p.diagData = append(p.diagData, b[:min(len(b), diagDataLen-len(p.diagData))]...)
+	}
+}
+
+// checkCrc compares the stored checksum of the current chunk
+// with the computed one.
+func (p *Reader) checkCrc(stored uint32) error {
+	computed := p.crc.Sum32()
+	if stored == computed || p.opts.IgnoreInputCRC || p.opts.Repair {
+		return nil
+	}
+	if p.opts.ChecksumDiagnostics {
+		return &ChecksumError{
+			ChunkType: p.chunkType,
+			Header:    append([]byte(nil), p.diagHead[:]...),
+			Data:      append([]byte(nil), p.diagData...),
+			Stored:    stored,
+			Computed:  computed,
+		}
+	}
+	if p.chunkType == "IDAT" {
+		return fmt.Errorf("%w of IDAT chunk", ErrBadChecksum)
+	}
+	return ErrBadChecksum
 }
 
 func (p *Reader) verifyCrc() error {
 	if _, err := io.ReadFull(p.r, p.tmp[:4]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
 		return err
 	}
-	if binary.BigEndian.Uint32(p.tmp[:4]) != p.crc.Sum32() {
-		return errors.New("pnglevel: invalid checksum")
+	if err := p.checkCrc(binary.BigEndian.Uint32(p.tmp[:4])); err != nil {
+		return err
 	}
-	p.w.Write(p.tmp[:4])
+	if p.recomputeCRC() {
+		binary.BigEndian.PutUint32(p.tmp[:4], p.crc.Sum32())
+	}
+	if !p.skip {
+		p.w.Write(p.tmp[:4])
+	}
+	p.chunkDone(p.chunkType, p.chunkSize)
 	p.crc.Reset()
 	return nil
 }
 
+// recomputeCRC reports whether the checksum of the current chunk
+// is replaced with the one computed over its data.
+func (p *Reader) recomputeCRC() bool {
+	return p.opts.Repair || (p.opts.RecomputeOutputCRC && !p.verbatim[p.chunkType])
+}
+
+// newCompressor returns a compressor writing to p.zbuf.
+func (p *Reader) newCompressor() (io.WriteCloser, error) {
+	if p.opts.Compressor != nil {
+		return p.opts.Compressor.NewWriter(&p.zbuf)
+	}
+	if p.opts.WindowBits != 0 && p.opts.WindowBits < 15 {
+		return newWindowWriter(&p.zbuf, p.opts.Level, p.opts.WindowBits, p.opts.RawDeflateIDAT)
+	}
+	if p.opts.Strategy == StrategyHuffmanOnly {
+		return newWindowWriter(&p.zbuf, flate.HuffmanOnly, 15, p.opts.RawDeflateIDAT)
+	}
+	if p.opts.RawDeflateIDAT {
+		return flate.NewWriterDict(&p.zbuf, p.opts.Level, p.opts.Dict)
+	}
+	if p.opts.Dict != nil {
+		return zlib.NewWriterLevelDict(&p.zbuf, p.opts.Level, p.opts.Dict)
+	}
+	if p.zlibW != nil && p.zlibLevel == p.opts.Level {
+		p.zlibW.Reset(&p.zbuf)
+		return p.zlibW, nil
+	}
+	zw, err := zlib.NewWriterLevel(&p.zbuf, p.opts.Level)
+	if err != nil {
+		return nil, err
+	}
+	p.zlibW, p.zlibLevel = zw, p.opts.Level
+	return zw, nil
+}
+
+// newDecompressor returns a zlib reader of image data from r,
+// reusing the one from the previous image, if any.
+func (p *Reader) newDecompressor(r io.Reader) (io.ReadCloser, error) {
+	if p.zlibR != nil {
+		if err := p.zlibR.(zlib.Resetter).Reset(r, nil); err != nil {
+			return nil, err
+		}
+		return p.zlibR, nil
+	}
+	zr, err := zlib.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	p.zlibR = zr
+	return zr, nil
+}
+
 func (p *Reader) handleIDAT() error {
+	if p.sink != nil {
+		return p.drainIDAT()
+	}
+	if p.pixels {
+		return p.handlePixels()
+	}
 	nr, rerr := p.zr.Read(p.buf)
 	if rerr != nil && rerr != io.EOF {
 		return rerr
 	}
-	_, err := p.zw.Write(p.buf[:nr])
-	if err != nil {
+	if p.keepOrig {
+		// Only read the rest of image data.
+		if rerr != io.EOF {
+			return nil
+		}
+		if err := p.writeIDAT(true); err != nil {
+			return err
+		}
+		return io.EOF
+	}
+	// Take the slot only once input has been read, so that waiting
+	// for a slow source doesn't hold up other Readers.
+	release := acquireCompression()
+	defer release()
+	if _, err := p.zw.Write(p.buf[:nr]); err != nil {
 		return err
 	}
-	err = p.zw.Flush()
-	if err != nil {
+	if p.opts.SkipIfNotBeneficial && p.origIDAT != nil && p.zbuf.Len() > p.origIDAT.Len() {
+		p.keepOrig = true
+		err := p.zw.Close()
+		p.zw = nil
+		p.zbuf.Reset()
 		return err
 	}
-	if rerr == io.EOF {
-		p.zw.Close()
+	// Let the compressor choose block boundaries, only
+	// writing IDAT chunks when enough data is accumulated.
+	if rerr != io.EOF {
+		return p.writeIDAT(false)
 	}
-	// Write length, chunk name, chunk data, crc.
-	err = binary.Write(&p.w, binary.BigEndian, uint32(p.zbuf.Len()))
-	if err != nil {
+	if err := p.zw.Close(); err != nil {
 		return err
 	}
-	_, err = io.WriteString(&p.w, "IDAT")
-	if err != nil {
+	if err := p.writeIDAT(true); err != nil {
 		return err
 	}
-	_, err = p.w.Write(p.zbuf.Bytes())
-	if err != nil {
+	return io.EOF
+}
+
+// writeIDAT writes compressed image data from p.zbuf as IDAT chunks
+// of idatSize bytes. If final is true, it also writes the remainder.
+// With CoalesceIDAT, all data is written as one chunk when final is true.
+// With KeepSmaller, nothing is written until final is true, and then the
+// original image data is written instead if its chunks are not larger.
+// With PreserveIDATLayout, chunks follow the input layout.
+func (p *Reader) writeIDAT(final bool) error {
+	if (p.opts.CoalesceIDAT || p.opts.KeepSmaller || p.opts.SkipIfNotBeneficial || p.opts.Repair) && !final {
+		return nil
+	}
+	p.writeStrays(true)
+	if p.origIDAT != nil && (p.keepOrig || p.idatChunksSize(p.origIDAT.Len(), true) <= p.idatChunksSize(p.zbuf.Len(), false)) {
+		p.zbuf.Reset()
+		p.zbuf.Write(p.origIDAT.Bytes())
+		if !p.opts.CoalesceIDAT && p.opts.IDATSize == 0 {
+			// Keep the input layout, which is not necessarily
+			// the one of 32K chunks.
+			for _, n := range p.origLayout {
+				p.writeIDATChunk(p.zbuf.Next(n))
+			}
+			p.zbuf.Reset()
+			p.writeStrays(false)
+			return nil
+		}
+	}
+	size := p.idatSize()
+	if p.opts.CoalesceIDAT {
+		if p.zbuf.Len() > maxChunkLen {
+			return errors.New("pnglevel: image data is too big for a single chunk")
+		}
+		size = p.zbuf.Len()
+	}
+	if p.opts.PreserveIDATLayout {
+		// Lengths are known as far as input has been read; any
+		// excess over them is written once image data is done.
+		for len(p.idatLayout) > 0 && p.zbuf.Len() > 0 && (final || p.zbuf.Len() >= p.idatLayout[0]) {
+			p.writeIDATChunk(p.zbuf.Next(p.idatLayout[0]))
+			p.idatLayout = p.idatLayout[1:]
+		}
+		if !final {
+			return nil
+		}
+	}
+	for p.zbuf.Len() > 0 && (final || p.zbuf.Len() >= size) {
+		p.writeIDATChunk(p.zbuf.Next(size))
+	}
+	p.writeStrays(false)
+	return nil
+}
+
+// idatChunksSize returns the size of IDAT chunks writeIDAT writes
+// for n bytes of image data, original if orig is true.
+func (p *Reader) idatChunksSize(n int, orig bool) int {
+	switch {
+	case p.opts.CoalesceIDAT:
+		return n + 12
+	case orig && p.opts.IDATSize == 0:
+		return n + 12*len(p.origLayout)
+	case p.opts.PreserveIDATLayout:
+		// Chunks follow the input layout, with any excess in
+		// additional chunks, so compare data alone.
+		return n
+	}
+	return n + 12*len(splitLengths(n, p.idatSize()))
+}
+
+// idatSize returns the maximum length of image data chunks written.
+func (p *Reader) idatSize() int {
+	if p.opts.IDATSize > 0 {
+		return p.opts.IDATSize
+	}
+	return bufSize
+}
+
+// writeStrays writes chunks found between IDAT chunks that must
+// precede image data, if before is true, or the others.
+func (p *Reader) writeStrays(before bool) {
+	for _, c := range p.strays {
+		if beforeIDAT[c.kind] == before {
+			p.writeChunk(c.kind, c.data, c.crc)
+		}
+	}
+	if !before {
+		p.strays = nil
+	}
+}
+
+// gatherIDAT reads image data for Repair, starting with the current
+// IDAT chunk, up to the first critical chunk following it, and returns
+// a reader of it. Ancillary chunks interrupting image data are
+// processed as any other chunk, and their output is saved for
+// writeStrays. The header of the critical chunk is left in p.head.
+func (p *Reader) gatherIDAT() (io.Reader, error) {
+	var data bytes.Buffer
+	kind := "IDAT"
+	for {
+		if kind == "IDAT" {
+			n, err := io.CopyN(io.MultiWriter(&data, p.crc), p.r, int64(p.chunkLen))
+			if p.origIDAT != nil {
+				p.origIDAT.Write(data.Bytes()[data.Len()-int(n):])
+			}
+			p.retain(data.Bytes()[data.Len()-int(n):])
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			if err != nil {
+				return nil, err
+			}
+			p.chunkLen = 0
+			if _, err := io.ReadFull(p.r, p.tmp[:4]); err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return nil, err
+			}
+			if err := p.checkCrc(binary.BigEndian.Uint32(p.tmp[:4])); err != nil {
+				return nil, err
+			}
+		} else {
+			mark := p.w.Len()
+			if err := p.beginChunk(p.chunkLen, kind); err != nil {
+				return nil, err
+			}
+			for p.stage = stChunkData; p.stage != stChunkHead; {
+				if err := p.refill(); err != nil {
+					if err == io.EOF {
+						err = io.ErrUnexpectedEOF
+					}
+					return nil, err
+				}
+			}
+			p.strays = append(p.strays, parseChunks(p.w.Bytes()[mark:])...)
+			p.w.Truncate(mark)
+		}
+		if _, err := io.ReadFull(p.r, p.head[:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		length, next, err := p.parseHeader()
+		if err != nil {
+			return nil, err
+		}
+		p.chunkLen, kind = length, next
+		if kind == "IDAT" {
+			p.startChunk(kind, length)
+			p.idatIn += int64(length)
+		} else if isCritical(kind) {
+			// The chunk is started by refill once image data is done.
+			p.chunkType = "IDAT"
+			p.readNonIDAT = true
+			return bytes.NewReader(data.Bytes()), nil
+		}
+	}
+}
+
+// writeIDATChunk writes b as an IDAT chunk.
+func (p *Reader) writeIDATChunk(b []byte) {
+	p.writeChunk("IDAT", b, chunkCRC(p.crcTable(), "IDAT", b))
+	p.idatOut += int64(len(b))
+	p.chunkDone("IDAT", len(b))
+}
+
+// drainIDAT copies a block of decompressed image data to p.sink.
+// It returns io.EOF when done.
+func (p *Reader) drainIDAT() error {
+	nr, err := p.zr.Read(p.buf)
+	if _, werr := p.sink.Write(p.buf[:nr]); werr != nil {
+		return werr
+	}
+	return err
+}
+
+// handlePixels decompresses the whole image data, applies pixel
+// transformations to it, and writes the held chunks followed by
+// the recompressed image data. It returns io.EOF when done.
+func (p *Reader) handlePixels() error {
+	var data bytes.Buffer
+	size := p.hdr.rawSize()
+	if _, err := data.ReadFrom(io.LimitReader(p.zr, size)); err != nil {
 		return err
 	}
-	io.WriteString(p.zcrc, "IDAT")
-	p.zcrc.Write(p.zbuf.Bytes())
-	err = binary.Write(&p.w, binary.BigEndian, p.zcrc.Sum32())
-	if err != nil {
+	if int64(data.Len()) < size {
+		return errShortImageData
+	}
+	// Read to the end of stream to verify its checksum.
+	for {
+		n, err := p.zr.Read(p.tmp[:1])
+		if n > 0 {
+			return errors.New("pnglevel: too much image data")
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	release := acquireCompression()
+	defer release()
+	raw := data.Bytes()
+	if err := unfilter(p.hdr, raw); err != nil {
 		return err
 	}
-	p.zcrc.Reset()
-	p.zbuf.Reset()
-	if rerr == io.EOF {
+	chunks := p.heldChunks()
+	if p.opts.InputPixelHash != nil {
+		if err := hashPixels(p.opts.InputPixelHash, p.hdr, raw, chunks); err != nil {
+			return err
+		}
+	}
+	if p.skipIDAT {
+		if err := p.writeHeld(chunks); err != nil {
+			return err
+		}
 		return io.EOF
 	}
-	return nil
+	h := p.hdr
+	if p.opts.DropOpaqueAlpha {
+		h, raw, chunks = p.dropAlpha(h, raw, chunks)
+	}
+	if p.opts.HonorSBIT {
+		h, raw = p.reduceDepth(h, raw, chunks)
+	}
+	if p.opts.OutputPixelHash != nil {
+		if err := hashPixels(p.opts.OutputPixelHash, h, raw, chunks); err != nil {
+			return err
+		}
+	}
+	if err := chooseFilters(h, raw, p.opts.Filter, p.opts.Level); err != nil {
+		return err
+	}
+	if h != p.hdr {
+		// Original image data doesn't match the new header.
+		p.origIDAT = nil
+	}
+	chunks[0].set(h.bytes(), p.crcTable())
+	if _, err := p.zw.Write(refilter(h, raw)); err != nil {
+		return err
+	}
+	if err := p.zw.Close(); err != nil {
+		return err
+	}
+	if err := p.writeHeld(chunks); err != nil {
+		return err
+	}
+	if err := p.writeIDAT(true); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+// reduceDepth lowers the bit depth of unfiltered image data
+// as allowed by its sBIT chunk, updating chunks that depend on it.
+func (p *Reader) reduceDepth(h ihdr, raw []byte, chunks []rawChunk) (ihdr, []byte) {
+	sbit, trns, bkgd := findChunk(chunks, "sBIT"), findChunk(chunks, "tRNS"), findChunk(chunks, "bKGD")
+	if sbit == nil || (trns != nil && p.verbatim["tRNS"]) || (bkgd != nil && p.verbatim["bKGD"]) {
+		return h, raw
+	}
+	var trnsData, bkgdData []byte
+	if trns != nil {
+		trnsData = trns.data
+	}
+	if bkgd != nil {
+		bkgdData = bkgd.data
+	}
+	nh, out, ntrns, nbkgd, ok := reduceDepth(h, raw, sbit.data, trnsData, bkgdData)
+	if !ok {
+		return h, raw
+	}
+	if trns != nil {
+		trns.set(ntrns, p.crcTable())
+	}
+	if bkgd != nil {
+		bkgd.set(nbkgd, p.crcTable())
+	}
+	return nh, out
+}
+
+// hashPixels writes decoded pixels of unfiltered image data to w,
+// using palette and transparency from chunks.
+func hashPixels(w io.Writer, h ihdr, raw []byte, chunks []rawChunk) error {
+	var plte, trns []byte
+	if c := findChunk(chunks, "PLTE"); c != nil {
+		plte = c.data
+	}
+	if c := findChunk(chunks, "tRNS"); c != nil {
+		trns = c.data
+	}
+	return writePixels(w, h, raw, plte, trns)
+}
+
+// dropAlpha removes the alpha channel from unfiltered image data
+// if it's fully opaque or uses a single transparent color, updating
+// chunks that depend on it.
+func (p *Reader) dropAlpha(h ihdr, raw []byte, chunks []rawChunk) (ihdr, []byte, []rawChunk) {
+	sbit := findChunk(chunks, "sBIT")
+	if sbit != nil && p.verbatim["sBIT"] {
+		return h, raw, chunks
+	}
+	nh, out, trns, ok := dropOpaqueAlpha(h, raw)
+	if !ok {
+		return h, raw, chunks
+	}
+	if sbit != nil && len(sbit.data) == h.channels() {
+		sbit.set(sbit.data[:nh.channels()], p.crcTable())
+	}
+	if trns != nil {
+		// Held chunks all precede image data, and tRNS must follow PLTE,
+		// so it goes last.
+		c := rawChunk{kind: "tRNS"}
+		c.set(trns, p.crcTable())
+		chunks = append(chunks, c)
+	}
+	return nh, out, chunks
 }
 
 type idatReader struct {
@@ -289,38 +1775,79 @@ func (p *idatReader) Read(b []byte) (nn int, err error) {
 	if len(b) == 0 {
 		return 0, nil
 	}
+	if p.r.readNonIDAT {
+		return 0, io.EOF
+	}
 	for p.r.chunkLen == 0 {
 		if _, err := io.ReadFull(p.r.r, p.r.tmp[:4]); err != nil {
 			return 0, err
 		}
-		if binary.BigEndian.Uint32(p.r.tmp[:4]) != p.r.crc.Sum32() {
-			return nn, fmt.Errorf("pnglevel: invalid checksum of IDAT chunk")
+		if err := p.r.checkCrc(binary.BigEndian.Uint32(p.r.tmp[:4])); err != nil {
+			return nn, err
 		}
-		if _, err := io.ReadFull(p.r.r, p.r.tmp[:8]); err != nil {
+		if _, err := io.ReadFull(p.r.r, p.r.head[:]); err != nil {
 			return 0, err
 		}
-		ulen := binary.BigEndian.Uint32(p.r.tmp[:4])
-		if ulen > maxChunkLen {
-			return 0, errors.New("pnglevel: chunk is too big")
-		}
-		p.r.chunkLen = int(ulen)
-		if p.r.chunkLen > maxChunkLen {
-			return 0, errors.New("pnglevel: IDAT chunk is too big")
+		length, kind, err := p.r.parseHeader()
+		if err != nil {
+			return 0, err
 		}
-		p.r.chunkType = string(p.r.tmp[4:8])
-		p.r.crc.Reset()
-		p.r.crc.Write(p.r.tmp[4:8])
-		if p.r.chunkType != "IDAT" {
+		p.r.chunkLen = length
+		if kind != "IDAT" {
+			// The chunk is started by refill once image data is done.
 			p.r.readNonIDAT = true
 			return 0, io.EOF
 		}
+		p.r.startChunk(kind, length)
+		p.r.idatIn += int64(length)
 	}
 	n, err := p.r.r.Read(b[:min(len(b), p.r.chunkLen)])
+	if p.r.origIDAT != nil {
+		p.r.origIDAT.Write(b[:n])
+	}
 	p.r.crc.Write(b[:n])
+	p.r.retain(b[:n])
 	p.r.chunkLen -= n
 	return n, err
 }
 
+// inflateLimiter is a reader of decompressed data that
+// enforces MaxDecompressedSize.
+type inflateLimiter struct {
+	io.ReadCloser
+	p *Reader
+}
+
+func (r *inflateLimiter) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.p.inflated += int64(n)
+	if max := r.p.opts.MaxDecompressedSize; max > 0 && r.p.inflated > max {
+		return n, ErrDecompressedTooLarge
+	}
+	return n, err
+}
+
+// contextReader is a reader that fails once its context is done.
+type contextReader struct {
+	io.ReadCloser
+	ctx context.Context
+}
+
+func (r *contextReader) Read(b []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.ReadCloser.Read(b)
+}
+
+// isCritical reports whether the chunk type has the critical bit set.
+func isCritical(kind string) bool {
+	return kind[0]&0x20 == 0
+}
+
+// maxInt is the largest value of int.
+const maxInt = int(^uint(0) >> 1)
+
 func min(a, b int) int {
 	if a < b {
 		return a
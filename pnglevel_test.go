@@ -0,0 +1,2598 @@
+package pnglevel_test
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/dchest/pnglevel"
+)
+
+// chunk is a PNG chunk of a test file.
+type chunk struct {
+	typ   string
+	data  []byte
+	crcOK bool
+}
+
+// buildPNG returns a PNG file consisting of the given chunks,
+// with correct lengths and checksums.
+func buildPNG(chunks ...chunk) []byte {
+	b := []byte("\x89PNG\r\n\x1a\n")
+	for _, c := range chunks {
+		b = appendChunk(b, c.typ, c.data)
+	}
+	return b
+}
+
+func appendChunk(b []byte, typ string, data []byte) []byte {
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(len(data)))
+	b = append(b, n[:]...)
+	start := len(b)
+	b = append(b, typ...)
+	b = append(b, data...)
+	binary.BigEndian.PutUint32(n[:], crc32.ChecksumIEEE(b[start:]))
+	return append(b, n[:]...)
+}
+
+// readChunks returns the chunks of the PNG file b.
+func readChunks(t *testing.T, b []byte) []chunk {
+	t.Helper()
+	if len(b) < 8 || string(b[:8]) != "\x89PNG\r\n\x1a\n" {
+		t.Fatal("missing PNG signature")
+	}
+	b = b[8:]
+	var chunks []chunk
+	for len(b) > 0 {
+		if len(b) < 12 {
+			t.Fatalf("truncated chunk: % x", b)
+		}
+		n := int(binary.BigEndian.Uint32(b))
+		if len(b) < 12+n {
+			t.Fatalf("chunk %q is truncated", b[4:8])
+		}
+		chunks = append(chunks, chunk{
+			typ:   string(b[4:8]),
+			data:  b[8 : 8+n],
+			crcOK: binary.BigEndian.Uint32(b[8+n:]) == crc32.ChecksumIEEE(b[4:8+n]),
+		})
+		b = b[12+n:]
+	}
+	return chunks
+}
+
+// chunkTypes returns the types of chunks.
+func chunkTypes(chunks []chunk) []string {
+	var types []string
+	for _, c := range chunks {
+		types = append(types, c.typ)
+	}
+	return types
+}
+
+// ihdrData returns IHDR chunk data.
+func ihdrData(width, height uint32, depth, colorType, interlace uint8) []byte {
+	b := make([]byte, 13)
+	binary.BigEndian.PutUint32(b, width)
+	binary.BigEndian.PutUint32(b[4:], height)
+	b[8], b[9], b[12] = depth, colorType, interlace
+	return b
+}
+
+// zlibData returns b compressed with the given level.
+func zlibData(t *testing.T, b []byte, level int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw, err := zlib.NewWriterLevel(&buf, level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw.Write(b)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// imageData returns the concatenated IDAT data of the PNG file b.
+func imageData(t *testing.T, b []byte) []byte {
+	t.Helper()
+	var data []byte
+	for _, c := range readChunks(t, b) {
+		if c.typ == "IDAT" {
+			data = append(data, c.data...)
+		}
+	}
+	return data
+}
+
+// testImage returns an opaque RGBA image with smooth gradients and noise.
+func testImage(width, height int) *image.RGBA {
+	rnd := rand.New(rand.NewSource(int64(width*height + 1)))
+	m := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			m.Set(x, y, color.RGBA{uint8(x + rnd.Intn(8)), uint8(y + rnd.Intn(8)), uint8(x*y/64 + rnd.Intn(8)), 255})
+		}
+	}
+	return m
+}
+
+// encodePNG encodes m with image/png at the given level.
+func encodePNG(t *testing.T, m image.Image, level png.CompressionLevel) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := (&png.Encoder{CompressionLevel: level}).Encode(&buf, m); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// repack recompresses src with opts, failing the test on error.
+func repack(t *testing.T, src []byte, opts pnglevel.Options) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	if err := pnglevel.RepackWithOptions(&out, bytes.NewReader(src), opts); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+// samePixels checks that PNG files a and b decode to the same image.
+func samePixels(t *testing.T, a, b []byte) {
+	t.Helper()
+	ma, err := png.Decode(bytes.NewReader(a))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mb, err := png.Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ma.Bounds() != mb.Bounds() {
+		t.Fatalf("bounds differ: %v, %v", ma.Bounds(), mb.Bounds())
+	}
+	r := ma.Bounds()
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			ca := color.NRGBA64Model.Convert(ma.At(x, y))
+			cb := color.NRGBA64Model.Convert(mb.At(x, y))
+			if ca != cb {
+				t.Fatalf("pixel (%d, %d) differs: %v, %v", x, y, ca, cb)
+			}
+		}
+	}
+}
+
+func TestHugeImageIsInvalid(t *testing.T) {
+	src := buildPNG(
+		chunk{typ: "IHDR", data: ihdrData(0x7fffffff, 0x7fffffff, 16, 6, 0)},
+		chunk{typ: "IDAT", data: zlibData(t, nil, 9)},
+		chunk{typ: "IEND"},
+	)
+	for _, opts := range []pnglevel.Options{
+		{Level: 9, DropOpaqueAlpha: true},
+		{Level: 9, Filter: pnglevel.FilterMinSum},
+		{Level: 9, HonorSBIT: true},
+	} {
+		err := pnglevel.RepackWithOptions(io.Discard, bytes.NewReader(src), opts)
+		if !errors.Is(err, pnglevel.ErrInvalidImage) {
+			t.Errorf("%+v: got %v, want ErrInvalidImage", opts, err)
+		}
+	}
+	if _, err := pnglevel.ImageFingerprint(bytes.NewReader(src)); !errors.Is(err, pnglevel.ErrInvalidImage) {
+		t.Errorf("ImageFingerprint: got %v, want ErrInvalidImage", err)
+	}
+}
+
+// splitIDAT returns the PNG file b with image data split into IDAT
+// chunks of n bytes, and stray inserted after the first of them.
+func splitIDAT(t *testing.T, b []byte, n int, stray ...chunk) []byte {
+	t.Helper()
+	var chunks []chunk
+	for _, c := range readChunks(t, b) {
+		switch c.typ {
+		case "IDAT":
+		case "IEND":
+			data := imageData(t, b)
+			for i := 0; i < len(data); i += n {
+				chunks = append(chunks, chunk{typ: "IDAT", data: data[i:min(i+n, len(data))]})
+				if i == 0 {
+					chunks = append(chunks, stray...)
+				}
+			}
+			chunks = append(chunks, c)
+		default:
+			chunks = append(chunks, c)
+		}
+	}
+	return buildPNG(chunks...)
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func TestPipeline(t *testing.T) {
+	src := encodePNG(t, testImage(300, 200), png.BestCompression)
+	plain := splitIDAT(t, src, 1000)
+	stray := splitIDAT(t, src, 700, chunk{typ: "tEXt", data: []byte("Comment\x00between IDAT")})
+	for _, tc := range []struct {
+		name string
+		src  []byte
+		opts pnglevel.Options
+	}{
+		{"default", plain, pnglevel.Options{Level: 6}},
+		{"small buffer", plain, pnglevel.Options{Level: 9, BufferSize: 100}},
+		{"SkipIfNotBeneficial", plain, pnglevel.Options{Level: 1, SkipIfNotBeneficial: true, BufferSize: 512}},
+		{"KeepSmaller", plain, pnglevel.Options{Level: 1, KeepSmaller: true}},
+		{"PreserveIDATLayout", plain, pnglevel.Options{Level: 9, PreserveIDATLayout: true}},
+		{"MaxGrowthFactor", plain, pnglevel.Options{Level: 9, MaxGrowthFactor: 1}},
+		{"Repair", stray, pnglevel.Options{Level: 9, Repair: true, BufferSize: 512}},
+		{"pixels", plain, pnglevel.Options{Level: 9, DropOpaqueAlpha: true, Filter: pnglevel.FilterMinSum}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var want, got []string
+			opts := tc.opts
+			opts.OnChunk = func(kind string, n int) { want = append(want, fmt.Sprint(kind, n)) }
+			out := repack(t, tc.src, opts)
+			opts.Pipeline = true
+			opts.OnChunk = func(kind string, n int) { got = append(got, fmt.Sprint(kind, n)) }
+			if b := repack(t, tc.src, opts); !bytes.Equal(b, out) {
+				t.Errorf("output differs with Pipeline: %d, %d bytes", len(b), len(out))
+			}
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("OnChunk differs with Pipeline:\n%v\n%v", got, want)
+			}
+			samePixels(t, src, out)
+		})
+	}
+}
+
+func TestPipelineAbort(t *testing.T) {
+	src := encodePNG(t, testImage(300, 200), png.BestCompression)
+	p, err := pnglevel.NewReaderWithOptions(bytes.NewReader(src), pnglevel.Options{Level: 9, Pipeline: true, BufferSize: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(p, make([]byte, 2000)); err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+	if _, err := p.Read(make([]byte, 1)); !errors.Is(err, pnglevel.ErrAborted) {
+		t.Errorf("got %v, want ErrAborted", err)
+	}
+}
+
+func TestRepairStrays(t *testing.T) {
+	src := encodePNG(t, testImage(100, 100), png.BestCompression)
+	bad := splitIDAT(t, src, 300,
+		chunk{typ: "tEXt", data: []byte("Comment\x00between IDAT")},
+		chunk{typ: "gAMA", data: []byte{0, 0, 0xb1, 0x8f}},
+		chunk{typ: "tIME", data: []byte{7, 0xe6, 1, 2, 3, 4, 5}},
+	)
+	if err := pnglevel.RepackWithOptions(io.Discard, bytes.NewReader(bad), pnglevel.Options{Level: 9}); err == nil {
+		t.Fatal("no error without Repair")
+	}
+	const all = "[IHDR gAMA IDAT tEXt tIME IEND]"
+	for _, tc := range []struct {
+		name string
+		opts pnglevel.Options
+		want string
+	}{
+		{"default", pnglevel.Options{Level: 9, Repair: true}, all},
+		{"small buffer", pnglevel.Options{Level: 9, Repair: true, BufferSize: 64}, all},
+		{"Pipeline", pnglevel.Options{Level: 9, Repair: true, Pipeline: true}, all},
+		{"KeepChunk", pnglevel.Options{Level: 9, Repair: true, KeepChunk: func(kind string) bool { return kind != "tEXt" }}, "[IHDR gAMA IDAT tIME IEND]"},
+		{"DropOpaqueAlpha", pnglevel.Options{Level: 9, Repair: true, DropOpaqueAlpha: true}, all},
+	} {
+		out := repack(t, bad, tc.opts)
+		if got := fmt.Sprint(chunkTypes(readChunks(t, out))); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+		samePixels(t, src, out)
+	}
+	// Input must not end inside image data.
+	trunc := bad[:len(bad)-12]
+	if err := pnglevel.RepackWithOptions(io.Discard, bytes.NewReader(trunc), pnglevel.Options{Level: 9, Repair: true}); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("truncated: got %v, want ErrUnexpectedEOF", err)
+	}
+}
+
+// errReader returns data followed by err.
+type errReader struct {
+	data []byte
+	err  error
+}
+
+func (r *errReader) Read(b []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, r.err
+	}
+	n := copy(b, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestTruncated(t *testing.T) {
+	chunks := readChunks(t, splitIDAT(t, encodePNG(t, testImage(20, 20), png.BestCompression), 200))
+	text := chunk{typ: "tEXt", data: []byte("Title\x00t")}
+	src := buildPNG(append(chunks[:len(chunks)-1:len(chunks)-1], text, chunks[len(chunks)-1])...)
+	if got := fmt.Sprint(chunkTypes(readChunks(t, src))); got != "[IHDR IDAT IDAT IDAT tEXt IEND]" {
+		t.Fatalf("bad test file: %s", got)
+	}
+	for _, opts := range []pnglevel.Options{
+		{Level: 9},
+		{Level: 9, Pipeline: true},
+		{Level: 9, Repair: true},
+		{Level: 9, DropOpaqueAlpha: true},
+		{Level: 9, Canonicalize: true},
+	} {
+		if err := pnglevel.RepackWithOptions(io.Discard, bytes.NewReader(src), opts); err != nil {
+			t.Fatalf("%+v: complete file: %v", opts, err)
+		}
+		for n := 0; n < len(src); n++ {
+			err := pnglevel.RepackWithOptions(io.Discard, bytes.NewReader(src[:n]), opts)
+			if !errors.Is(err, pnglevel.ErrTruncated) {
+				t.Fatalf("truncated at %d of %d: got %v, want ErrTruncated", n, len(src), err)
+			}
+		}
+	}
+	// Read errors are not reported as truncation.
+	errRead := errors.New("read error")
+	for _, n := range []int{0, 10, 40, len(src) - 12} {
+		err := pnglevel.RepackWithOptions(io.Discard, &errReader{src[:n], errRead}, pnglevel.Options{Level: 9})
+		if !errors.Is(err, errRead) || errors.Is(err, pnglevel.ErrTruncated) {
+			t.Errorf("error at %d: got %v, want read error", n, err)
+		}
+	}
+}
+
+func TestReadBytesPerSecond(t *testing.T) {
+	src := encodePNG(t, testImage(200, 200), png.NoCompression)
+	const rate = 64 << 10
+	opts := pnglevel.Options{Level: 1, ReadBytesPerSecond: rate}
+	start := time.Now()
+	if err := pnglevel.RepackWithOptions(io.Discard, bytes.NewReader(src), opts); err != nil {
+		t.Fatal(err)
+	}
+	// The first second's worth of input is not delayed.
+	if d, want := time.Since(start), time.Duration(len(src)-rate)*time.Second/rate; d < want*9/10 {
+		t.Errorf("read %d bytes in %v, want at least %v", len(src), d, want)
+	}
+	// A corrupt length doesn't make the Reader wait for data that
+	// isn't there.
+	bad := append(src[:33:33], 0x7f, 0xff, 0xff, 0xff, 'I', 'D', 'A', 'T')
+	bad = append(bad, src[41:141]...)
+	start = time.Now()
+	err := pnglevel.RepackWithOptions(io.Discard, bytes.NewReader(bad), opts)
+	if !errors.Is(err, pnglevel.ErrTruncated) {
+		t.Errorf("corrupt length: got %v, want ErrTruncated", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("corrupt length: took %v", d)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	src := encodePNG(t, testImage(50, 40), png.BestCompression)
+	want := repack(t, src, pnglevel.Options{Level: 9})
+	for _, n := range []int{1, 7, 100, len(src)} {
+		var out bytes.Buffer
+		z := pnglevel.NewWriter(&out, 9)
+		for b := src; len(b) > 0; b = b[min(n, len(b)):] {
+			if _, err := z.Write(b[:min(n, len(b))]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := z.Close(); err != nil {
+			t.Fatalf("writes of %d bytes: %v", n, err)
+		}
+		if !bytes.Equal(out.Bytes(), want) {
+			t.Errorf("writes of %d bytes: output differs from Repack", n)
+		}
+	}
+	for _, n := range []int{len(src) - 12, len(src) - 5, 40} {
+		z := pnglevel.NewWriter(io.Discard, 9)
+		z.Write(src[:n])
+		if err := z.Close(); !errors.Is(err, pnglevel.ErrTruncated) {
+			t.Errorf("input cut at %d: got %v, want ErrTruncated", n, err)
+		}
+	}
+}
+
+func TestCompressionConcurrency(t *testing.T) {
+	pnglevel.SetMaxCompressionConcurrency(1)
+	defer pnglevel.SetMaxCompressionConcurrency(0)
+	src := encodePNG(t, testImage(200, 200), png.NoCompression)
+	want := repack(t, src, pnglevel.Options{Level: 9})
+	// The first Writer is left waiting for input in the middle of
+	// image data while the second one processes a whole file.
+	var out1, out2 bytes.Buffer
+	z1 := pnglevel.NewWriter(&out1, 9)
+	done := make(chan error, 1)
+	go func() {
+		if _, err := z1.Write(src[:len(src)/2]); err != nil {
+			done <- err
+			return
+		}
+		z2 := pnglevel.NewWriter(&out2, 9)
+		if _, err := z2.Write(src); err != nil {
+			done <- err
+			return
+		}
+		if err := z2.Close(); err != nil {
+			done <- err
+			return
+		}
+		if _, err := z1.Write(src[len(src)/2:]); err != nil {
+			done <- err
+			return
+		}
+		done <- z1.Close()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Writers deadlocked")
+	}
+	if !bytes.Equal(out1.Bytes(), want) || !bytes.Equal(out2.Bytes(), want) {
+		t.Error("output differs from Repack")
+	}
+}
+
+// buildAPNG returns an APNG file with a frame for each image, the
+// first stored in IDAT, and the others in fdAT chunks of n bytes.
+// Frame data is compressed with the given level.
+func buildAPNG(t *testing.T, images []*image.RGBA, level, n int, extra ...chunk) []byte {
+	t.Helper()
+	b := images[0].Bounds()
+	chunks := readChunks(t, encodePNG(t, images[0], png.NoCompression))
+	out := []chunk{chunks[0]}
+	out = append(out, extra...)
+	actl := make([]byte, 8)
+	binary.BigEndian.PutUint32(actl, uint32(len(images)))
+	out = append(out, chunk{typ: "acTL", data: actl})
+	seq := uint32(0)
+	for i, m := range images {
+		fctl := make([]byte, 26)
+		binary.BigEndian.PutUint32(fctl, seq)
+		binary.BigEndian.PutUint32(fctl[4:], uint32(b.Dx()))
+		binary.BigEndian.PutUint32(fctl[8:], uint32(b.Dy()))
+		out = append(out, chunk{typ: "fcTL", data: fctl})
+		seq++
+		z := zlibData(t, inflate(t, imageData(t, encodePNG(t, m, png.NoCompression))), level)
+		if i == 0 {
+			out = append(out, chunk{typ: "IDAT", data: z})
+			continue
+		}
+		for len(z) > 0 {
+			data := make([]byte, 4, 4+n)
+			binary.BigEndian.PutUint32(data, seq)
+			out = append(out, chunk{typ: "fdAT", data: append(data, z[:min(n, len(z))]...)})
+			seq++
+			z = z[min(n, len(z)):]
+		}
+	}
+	return buildPNG(append(out, chunk{typ: "IEND"})...)
+}
+
+// inflate returns the decompressed zlib stream b.
+func inflate(t *testing.T, b []byte) []byte {
+	t.Helper()
+	zr, err := zlib.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// apngFrames returns the compressed data of each frame of the APNG
+// file b and the total size of chunks holding it, checking that
+// sequence numbers are consecutive.
+func apngFrames(t *testing.T, b []byte) (frames [][]byte, sizes []int) {
+	t.Helper()
+	seq := uint32(0)
+	for _, c := range readChunks(t, b) {
+		switch c.typ {
+		case "fcTL", "fdAT":
+			if got := binary.BigEndian.Uint32(c.data); got != seq {
+				t.Fatalf("%s sequence number is %d, want %d", c.typ, got, seq)
+			}
+			seq++
+			if c.typ == "fcTL" {
+				frames = append(frames, nil)
+				sizes = append(sizes, 0)
+				continue
+			}
+			frames[len(frames)-1] = append(frames[len(frames)-1], c.data[4:]...)
+			sizes[len(sizes)-1] += 12 + len(c.data)
+		case "IDAT":
+			frames[len(frames)-1] = append(frames[len(frames)-1], c.data...)
+			sizes[len(sizes)-1] += 12 + len(c.data)
+		}
+	}
+	return frames, sizes
+}
+
+func TestAPNGFrames(t *testing.T) {
+	images := []*image.RGBA{testImage(40, 30), testImage(40, 30), testImage(40, 30)}
+	for i, m := range images {
+		for j := range m.Pix {
+			m.Pix[j] += uint8(i * 50)
+		}
+	}
+	profile := bytes.Repeat([]byte("profile data "), 100)
+	iccp := chunk{typ: "iCCP", data: append([]byte("ICC\x00\x00"), zlibData(t, profile, 9)...)}
+	src := buildAPNG(t, images, 1, 300, iccp)
+	inFrames, inSizes := apngFrames(t, src)
+	best := pnglevel.CompressorFunc(func(w io.Writer) (io.WriteCloser, error) {
+		return zlib.NewWriterLevel(w, zlib.BestCompression)
+	})
+	for _, tc := range []struct {
+		name string
+		opts pnglevel.Options
+	}{
+		{"level 9", pnglevel.Options{Level: 9}},
+		{"IDATSize", pnglevel.Options{Level: 9, IDATSize: 200}},
+		{"Compressor", pnglevel.Options{Compressor: best}},
+		{"level 0", pnglevel.Options{Level: 0}},
+	} {
+		out := repack(t, src, tc.opts)
+		frames, sizes := apngFrames(t, out)
+		if len(frames) != len(inFrames) {
+			t.Fatalf("%s: got %d frames, want %d", tc.name, len(frames), len(inFrames))
+		}
+		for i := range frames {
+			if !bytes.Equal(inflate(t, frames[i]), inflate(t, inFrames[i])) {
+				t.Errorf("%s: frame %d differs", tc.name, i)
+			}
+			if i > 0 && sizes[i] > inSizes[i] {
+				t.Errorf("%s: frame %d grew from %d to %d bytes", tc.name, i, inSizes[i], sizes[i])
+			}
+		}
+		for _, c := range readChunks(t, out) {
+			if c.typ == "iCCP" && tc.opts.Compressor != nil && len(c.data) > len(iccp.data) {
+				t.Errorf("%s: iCCP grew from %d to %d bytes", tc.name, len(iccp.data), len(c.data))
+			}
+			if c.typ == "fdAT" && tc.opts.IDATSize > 0 && len(c.data) > tc.opts.IDATSize {
+				t.Errorf("%s: fdAT chunk of %d bytes", tc.name, len(c.data))
+			}
+		}
+		samePixels(t, src, out)
+	}
+}
+
+func TestKeepSmallerNotLarger(t *testing.T) {
+	m := testImage(120, 80)
+	best := encodePNG(t, m, png.BestCompression)
+	profile := bytes.Repeat([]byte("profile data "), 100)
+	images := []*image.RGBA{m, testImage(120, 80)}
+	inputs := map[string][]byte{
+		"best":         best,
+		"small chunks": splitIDAT(t, best, 100),
+		"one chunk":    splitIDAT(t, encodePNG(t, testImage(300, 200), png.BestCompression), 1<<20),
+		"APNG": buildAPNG(t, images, 9, 1000,
+			chunk{typ: "iCCP", data: append([]byte("ICC\x00\x00"), zlibData(t, profile, 9)...)},
+			chunk{typ: "zTXt", data: append([]byte("Comment\x00\x00"), zlibData(t, profile, 9)...)},
+		),
+	}
+	best9 := pnglevel.CompressorFunc(func(w io.Writer) (io.WriteCloser, error) {
+		return zlib.NewWriterLevel(w, zlib.BestCompression)
+	})
+	for name, src := range inputs {
+		for _, opts := range []pnglevel.Options{
+			{Level: 0},
+			{Level: 1},
+			{Level: 9},
+			{Level: zlib.HuffmanOnly},
+			{Compressor: best9},
+			{Level: 0, SkipIfNotBeneficial: true},
+			{Level: 0, Pipeline: true},
+			{Level: 0, CoalesceIDAT: true},
+			{Level: 0, PreserveIDATLayout: true},
+			{Level: 0, Filter: pnglevel.FilterMinSum},
+			{Level: 0, CompressText: true},
+		} {
+			opts.KeepSmaller = true
+			out := repack(t, src, opts)
+			if len(out) > len(src) {
+				t.Errorf("%s: %+v: output grew from %d to %d bytes", name, opts, len(src), len(out))
+			}
+			samePixels(t, src, out)
+		}
+	}
+}
+
+func TestSkipIfNotBeneficial(t *testing.T) {
+	for _, m := range []*image.RGBA{testImage(120, 80), testImage(300, 200)} {
+		src := encodePNG(t, m, png.BestCompression)
+		if bytes.Equal(imageData(t, repack(t, src, pnglevel.Options{Level: 0})), imageData(t, src)) {
+			t.Fatal("bad test file: recompression doesn't change image data")
+		}
+		for _, opts := range []pnglevel.Options{
+			{Level: 9, SkipIfNotBeneficial: true},
+			{Level: 0, SkipIfNotBeneficial: true},
+			{Level: 0, SkipIfNotBeneficial: true, Pipeline: true},
+		} {
+			out := repack(t, src, opts)
+			if !bytes.Equal(imageData(t, out), imageData(t, src)) {
+				t.Errorf("%v: %+v: image data was recompressed", m.Bounds(), opts)
+			}
+		}
+	}
+}
+
+func TestOrderFuncPalette(t *testing.T) {
+	pal := image.NewPaletted(image.Rect(0, 0, 16, 16), color.Palette{color.Black, color.White, color.Gray{128}})
+	for i := range pal.Pix {
+		pal.Pix[i] = uint8(i % 3)
+	}
+	chunks := readChunks(t, encodePNG(t, pal, png.BestCompression))
+	if got := fmt.Sprint(chunkTypes(chunks)); got != "[IHDR PLTE IDAT IEND]" {
+		t.Fatalf("bad test file: %s", got)
+	}
+	src := buildPNG(chunks[0],
+		chunk{typ: "gAMA", data: []byte{0, 0, 0xb1, 0x8f}},
+		chunk{typ: "sRGB", data: []byte{0}},
+		chunks[1],
+		chunk{typ: "pHYs", data: []byte{0, 0, 0x0b, 0x13, 0, 0, 0x0b, 0x13, 1}},
+		chunk{typ: "tEXt", data: []byte("Title\x00t")},
+		chunks[2], chunks[3])
+	identity := func(c []pnglevel.Chunk) ([]pnglevel.Chunk, []pnglevel.Chunk) { return c, nil }
+	reverse := func(c []pnglevel.Chunk) ([]pnglevel.Chunk, []pnglevel.Chunk) {
+		var r []pnglevel.Chunk
+		for i := len(c) - 1; i >= 0; i-- {
+			r = append(r, c[i])
+		}
+		return r, nil
+	}
+	textLast := func(c []pnglevel.Chunk) (before, after []pnglevel.Chunk) {
+		for _, c := range c {
+			if c.Type == "tEXt" {
+				after = append(after, c)
+			} else {
+				before = append(before, c)
+			}
+		}
+		return before, after
+	}
+	for _, tc := range []struct {
+		name  string
+		order func([]pnglevel.Chunk) ([]pnglevel.Chunk, []pnglevel.Chunk)
+		want  string
+	}{
+		{"identity", identity, "[IHDR gAMA sRGB PLTE pHYs tEXt IDAT IEND]"},
+		{"reverse", reverse, "[IHDR sRGB gAMA PLTE tEXt pHYs IDAT IEND]"},
+		{"text last", textLast, "[IHDR gAMA sRGB PLTE pHYs IDAT tEXt IEND]"},
+	} {
+		out := repack(t, src, pnglevel.Options{Level: 9, OrderFunc: tc.order})
+		if got := fmt.Sprint(chunkTypes(readChunks(t, out))); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+		samePixels(t, src, out)
+	}
+	physLast := func(c []pnglevel.Chunk) ([]pnglevel.Chunk, []pnglevel.Chunk) { return nil, c }
+	if err := pnglevel.RepackWithOptions(io.Discard, bytes.NewReader(src), pnglevel.Options{Level: 9, OrderFunc: physLast}); err == nil {
+		t.Error("no error for pHYs after image data")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	profile := bytes.Repeat([]byte("profile data "), 100)
+	iccp := append([]byte("ICC\x00\x00"), zlibData(t, profile, 9)...)
+	images := []*image.RGBA{testImage(30, 20), testImage(30, 20)}
+	src := buildAPNG(t, images, 9, 200, chunk{typ: "iCCP", data: iccp})
+	if err := pnglevel.Verify(bytes.NewReader(src)); err != nil {
+		t.Fatalf("valid file: %v", err)
+	}
+	// corrupt returns src with the data of the i-th chunk of the given
+	// type changed by f, and a correct checksum.
+	corrupt := func(typ string, i int, f func([]byte)) []byte {
+		var chunks []chunk
+		for _, c := range readChunks(t, src) {
+			if c.typ == typ {
+				if i == 0 {
+					c.data = append([]byte(nil), c.data...)
+					f(c.data)
+				}
+				i--
+			}
+			chunks = append(chunks, c)
+		}
+		return buildPNG(chunks...)
+	}
+	badCRC := append([]byte(nil), src...)
+	badCRC[8+8+13] ^= 1
+	for _, tc := range []struct {
+		name string
+		src  []byte
+	}{
+		{"bad checksum", badCRC},
+		{"corrupt image data", corrupt("IDAT", 0, func(b []byte) { b[len(b)/2] ^= 0xff; b[len(b)-1] ^= 0xff })},
+		{"corrupt frame", corrupt("fdAT", 1, func(b []byte) { b[len(b)-1] ^= 0xff })},
+		{"corrupt profile", corrupt("iCCP", 0, func(b []byte) { b[len(b)-1] ^= 0xff })},
+		{"missing IEND", src[:len(src)-12]},
+	} {
+		if err := pnglevel.Verify(bytes.NewReader(tc.src)); err == nil {
+			t.Errorf("%s: no error", tc.name)
+		}
+	}
+}
+
+func TestStrategy(t *testing.T) {
+	flat := image.NewRGBA(image.Rect(0, 0, 200, 200))
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 200; x++ {
+			flat.Set(x, y, color.RGBA{uint8(x / 50 * 60), 0, uint8(y / 50 * 60), 255})
+		}
+	}
+	for _, tc := range []struct {
+		name string
+		m    image.Image
+	}{
+		{"photographic", testImage(200, 200)},
+		{"flat", flat},
+	} {
+		src := encodePNG(t, tc.m, png.NoCompression)
+		def := repack(t, src, pnglevel.Options{Level: 9})
+		huff := repack(t, src, pnglevel.Options{Level: 9, Strategy: pnglevel.StrategyHuffmanOnly})
+		samePixels(t, src, def)
+		samePixels(t, src, huff)
+		// The stream is the same as written by zlib at the HuffmanOnly level.
+		if want := repack(t, src, pnglevel.Options{Level: zlib.HuffmanOnly}); !bytes.Equal(huff, want) {
+			t.Errorf("%s: Huffman-only output differs from HuffmanOnly level", tc.name)
+		}
+		t.Logf("%s: default %d bytes, Huffman-only %d bytes", tc.name, len(def), len(huff))
+		if tc.name == "flat" && len(huff) <= len(def) {
+			t.Errorf("flat: Huffman-only output is not larger: %d, %d bytes", len(huff), len(def))
+		}
+	}
+	for _, opts := range []pnglevel.Options{
+		{Strategy: 2},
+		{Strategy: -1},
+		{Strategy: pnglevel.StrategyHuffmanOnly, Dict: []byte("dict")},
+	} {
+		if _, err := pnglevel.NewReaderWithOptions(nil, opts); err == nil {
+			t.Errorf("%+v: no error", opts)
+		}
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	src := encodePNG(t, testImage(300, 200), png.DefaultCompression)
+	inputs := [][]byte{src, splitIDAT(t, src, 100), splitIDAT(t, src, 1<<20)}
+	var want []byte
+	for i := 0; i < 2; i++ {
+		for j, in := range inputs {
+			var out bytes.Buffer
+			if err := pnglevel.RepackDeterministic(&out, bytes.NewReader(in), 9); err != nil {
+				t.Fatal(err)
+			}
+			if want == nil {
+				want = out.Bytes()
+			} else if !bytes.Equal(out.Bytes(), want) {
+				t.Errorf("run %d, input %d: output differs", i, j)
+			}
+			fp, err := pnglevel.Fingerprint(bytes.NewReader(in), 9)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sum := sha256.Sum256(want); !bytes.Equal(fp, sum[:]) {
+				t.Errorf("run %d, input %d: fingerprint doesn't match output", i, j)
+			}
+		}
+	}
+	// Output is the same as with options that don't affect it.
+	for _, opts := range []pnglevel.Options{
+		{Level: 9, BufferSize: 100},
+		{Level: 9, Pipeline: true},
+		{Level: 9, Pipeline: true, BufferSize: 1000},
+	} {
+		if out := repack(t, splitIDAT(t, src, 500), opts); !bytes.Equal(out, want) {
+			t.Errorf("%+v: output differs from RepackDeterministic", opts)
+		}
+	}
+	samePixels(t, src, want)
+}
+
+func TestScanTruncated(t *testing.T) {
+	src := splitIDAT(t, encodePNG(t, testImage(20, 20), png.BestCompression), 300)
+	want := readChunks(t, src)
+	chunks, err := pnglevel.ListChunks(bytes.NewReader(src))
+	if err != nil || len(chunks) != len(want) {
+		t.Fatalf("got %d chunks, %v; want %d chunks", len(chunks), err, len(want))
+	}
+	for n := 0; n < len(src); n++ {
+		_, err := pnglevel.ListChunks(bytes.NewReader(src[:n]))
+		if !errors.Is(err, pnglevel.ErrTruncated) {
+			t.Fatalf("ListChunks: truncated at %d of %d: got %v, want ErrTruncated", n, len(src), err)
+		}
+		err = pnglevel.Scan(bytes.NewReader(src[:n]), func(string, int, bool) error { return nil })
+		if !errors.Is(err, pnglevel.ErrTruncated) {
+			t.Fatalf("Scan: truncated at %d of %d: got %v, want ErrTruncated", n, len(src), err)
+		}
+	}
+	errRead := errors.New("read error")
+	if err := pnglevel.Scan(&errReader{src[:50], errRead}, func(string, int, bool) error { return nil }); err != errRead {
+		t.Errorf("got %v, want read error", err)
+	}
+}
+
+func TestRepairPaddedIHDR(t *testing.T) {
+	src := encodePNG(t, testImage(20, 10), png.BestCompression)
+	chunks := readChunks(t, src)
+	ihdr := chunks[0].data[:13:13]
+	padded := buildPNG(append([]chunk{{typ: "IHDR", data: append(ihdr, 0)}}, chunks[1:]...)...)
+	if err := pnglevel.RepackWithOptions(io.Discard, bytes.NewReader(padded), pnglevel.Options{Level: 9}); !errors.Is(err, pnglevel.ErrBadIHDRLength) {
+		t.Fatalf("without Repair: got %v, want ErrBadIHDRLength", err)
+	}
+	var lengths []int
+	out := repack(t, padded, pnglevel.Options{Level: 9, Repair: true, OnChunk: func(kind string, n int) {
+		if kind == "IHDR" {
+			lengths = append(lengths, n)
+		}
+	}})
+	got := readChunks(t, out)
+	if len(got[0].data) != 13 || !got[0].crcOK || fmt.Sprint(lengths) != "[13]" {
+		t.Errorf("IHDR of %d bytes, checksum valid: %v, OnChunk lengths %v", len(got[0].data), got[0].crcOK, lengths)
+	}
+	samePixels(t, src, out)
+	// The checksum must cover the padding.
+	bad := append([]byte(nil), padded...)
+	binary.BigEndian.PutUint32(bad[8+8+14:], crc32.ChecksumIEEE(append([]byte("IHDR"), ihdr...)))
+	if err := pnglevel.RepackWithOptions(io.Discard, bytes.NewReader(bad), pnglevel.Options{Level: 9, Repair: true}); !errors.Is(err, pnglevel.ErrBadIHDRLength) {
+		t.Errorf("checksum without padding: got %v, want ErrBadIHDRLength", err)
+	}
+	tooLong := buildPNG(append([]chunk{{typ: "IHDR", data: append(ihdr, 0, 0, 0, 0, 0)}}, chunks[1:]...)...)
+	if err := pnglevel.RepackWithOptions(io.Discard, bytes.NewReader(tooLong), pnglevel.Options{Level: 9, Repair: true}); !errors.Is(err, pnglevel.ErrBadIHDRLength) {
+		t.Errorf("5 bytes of padding: got %v, want ErrBadIHDRLength", err)
+	}
+}
+
+func TestRepackWithStats(t *testing.T) {
+	raw := make([]byte, 4*(1+8))
+	for i := range raw {
+		if i%9 != 0 {
+			raw[i] = uint8(i * 3)
+		}
+	}
+	z := zlibData(t, raw, zlib.NoCompression)
+	src := buildPNG(
+		chunk{typ: "IHDR", data: ihdrData(8, 4, 8, 0, 0)},
+		chunk{typ: "tEXt", data: []byte("Comment\x00stats")},
+		chunk{typ: "IDAT", data: z[:10]},
+		chunk{typ: "IDAT", data: z[10:11]},
+		chunk{typ: "IDAT", data: z[11:]},
+		chunk{typ: "IEND"},
+	)
+	var out bytes.Buffer
+	s, err := pnglevel.RepackWithStats(&out, bytes.NewReader(src), zlib.BestCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := pnglevel.Stats{
+		OriginalIDATBytes: int64(len(z)),
+		NewIDATBytes:      int64(len(imageData(t, out.Bytes()))),
+		TotalIn:           int64(len(src)),
+		TotalOut:          int64(out.Len()),
+		ChunkCount:        6,
+	}
+	if s != want {
+		t.Errorf("got %+v, want %+v", s, want)
+	}
+	samePixels(t, src, out.Bytes())
+}
+
+var filterHeuristics = []struct {
+	name string
+	fh   pnglevel.FilterHeuristic
+}{
+	{"None", pnglevel.FilterNone},
+	{"MinSum", pnglevel.FilterMinSum},
+	{"Entropy", pnglevel.FilterEntropy},
+	{"BruteForce", pnglevel.FilterBruteForce},
+}
+
+func TestFilterHeuristics(t *testing.T) {
+	pal := image.NewPaletted(image.Rect(0, 0, 41, 33), color.Palette{color.Black, color.White, color.Gray{128}})
+	for i := range pal.Pix {
+		pal.Pix[i] = uint8(i % 3)
+	}
+	gray := image.NewGray16(image.Rect(0, 0, 41, 33))
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i * 5)
+	}
+	for _, m := range []image.Image{testImage(150, 100), pal, gray} {
+		src := encodePNG(t, m, png.NoCompression)
+		for _, h := range filterHeuristics {
+			samePixels(t, src, repack(t, src, pnglevel.Options{Level: 9, Filter: h.fh}))
+		}
+	}
+}
+
+// BenchmarkFilter reports the output size for each filter heuristic
+// on a photo-like image whose filters were chosen by image/png.
+func BenchmarkFilter(b *testing.B) {
+	m := testImage(512, 384)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, m); err != nil {
+		b.Fatal(err)
+	}
+	src := buf.Bytes()
+	for _, h := range filterHeuristics {
+		b.Run(h.name, func(b *testing.B) {
+			opts := pnglevel.Options{Level: 9, Filter: h.fh}
+			var out bytes.Buffer
+			b.SetBytes(int64(len(src)))
+			for i := 0; i < b.N; i++ {
+				out.Reset()
+				if err := pnglevel.RepackWithOptions(&out, bytes.NewReader(src), opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(out.Len()), "bytes")
+		})
+	}
+}
+
+// forwardReader reads from r, failing the test if it's used
+// as anything other than an io.Reader.
+type forwardReader struct {
+	t *testing.T
+	r io.Reader
+}
+
+func (r *forwardReader) Read(b []byte) (int, error) { return r.r.Read(b) }
+
+func (r *forwardReader) Seek(int64, int) (int64, error) {
+	r.t.Error("Seek called")
+	return 0, errors.New("not seekable")
+}
+
+func (r *forwardReader) ReadAt([]byte, int64) (int, error) {
+	r.t.Error("ReadAt called")
+	return 0, errors.New("not seekable")
+}
+
+func TestForwardOnly(t *testing.T) {
+	src := splitIDAT(t, encodePNG(t, testImage(100, 80), png.BestSpeed), 500, chunk{typ: "tEXt", data: []byte("Comment\x00stray")})
+	clean := encodePNG(t, testImage(100, 80), png.BestSpeed)
+	for _, opts := range []pnglevel.Options{
+		{Level: 9, Repair: true},
+		{Level: 9, Repair: true, Pipeline: true},
+		{Level: 9, Repair: true, KeepSmaller: true, CoalesceIDAT: true},
+		{Level: 9, Repair: true, Filter: pnglevel.FilterMinSum, Dedup: true},
+	} {
+		var out bytes.Buffer
+		if err := pnglevel.RepackWithOptions(&out, &forwardReader{t, iotest.OneByteReader(bytes.NewReader(src))}, opts); err != nil {
+			t.Fatalf("%+v: %v", opts, err)
+		}
+		samePixels(t, clean, out.Bytes())
+	}
+}
+
+var largePNG struct {
+	once sync.Once
+	b    []byte
+}
+
+// largeImage returns a PNG file of a large photo-like image.
+func largeImage(b *testing.B) []byte {
+	largePNG.once.Do(func() {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, testImage(1024, 1024)); err != nil {
+			b.Fatal(err)
+		}
+		largePNG.b = buf.Bytes()
+	})
+	return largePNG.b
+}
+
+// peakWriter discards data written to it, sampling the heap size
+// every 64 KiB to record its peak.
+type peakWriter struct {
+	n    int
+	peak uint64
+}
+
+func (w *peakWriter) Write(b []byte) (int, error) {
+	for w.n += len(b); w.n >= 64<<10; w.n -= 64 << 10 {
+		w.sample()
+	}
+	return len(b), nil
+}
+
+func (w *peakWriter) sample() {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	if ms.HeapInuse > w.peak {
+		w.peak = ms.HeapInuse
+	}
+}
+
+// BenchmarkMemory reports allocations and the peak heap size of
+// the streaming default and the modes that buffer image data.
+func BenchmarkMemory(b *testing.B) {
+	src := largeImage(b)
+	for _, bm := range []struct {
+		name string
+		opts pnglevel.Options
+	}{
+		{"Streaming", pnglevel.Options{Level: 6}},
+		{"CoalesceIDAT", pnglevel.Options{Level: 6, CoalesceIDAT: true}},
+		{"KeepSmaller", pnglevel.Options{Level: 6, KeepSmaller: true}},
+		{"SkipIfNotBeneficial", pnglevel.Options{Level: 6, SkipIfNotBeneficial: true}},
+		{"MaxGrowthFactor", pnglevel.Options{Level: 6, MaxGrowthFactor: 1}},
+		{"Filter", pnglevel.Options{Level: 6, Filter: pnglevel.FilterMinSum}},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			var peak uint64
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				runtime.GC()
+				w := new(peakWriter)
+				w.sample()
+				base := w.peak
+				b.StartTimer()
+				if err := pnglevel.RepackWithOptions(w, bytes.NewReader(src), bm.opts); err != nil {
+					b.Fatal(err)
+				}
+				w.sample()
+				if w.peak-base > peak {
+					peak = w.peak - base
+				}
+			}
+			b.ReportMetric(float64(peak), "peak-heap-B")
+		})
+	}
+}
+
+// corruptCRC returns a copy of the PNG file b with the checksum
+// of the first chunk of the given type inverted.
+func corruptCRC(t *testing.T, b []byte, typ string) []byte {
+	t.Helper()
+	b = append([]byte(nil), b...)
+	for off := 8; off+12 <= len(b); {
+		n := int(binary.BigEndian.Uint32(b[off:]))
+		if string(b[off+4:off+8]) == typ {
+			crc := b[off+8+n : off+12+n]
+			binary.BigEndian.PutUint32(crc, ^binary.BigEndian.Uint32(crc))
+			return b
+		}
+		off += 12 + n
+	}
+	t.Fatalf("no %s chunk", typ)
+	return nil
+}
+
+func TestCRCOptions(t *testing.T) {
+	src := encodePNG(t, testImage(30, 20), png.BestSpeed)
+	chunks := readChunks(t, src)
+	src = buildPNG(append(chunks[:1:1], append([]chunk{{typ: "tEXt", data: []byte("Comment\x00crc")}}, chunks[1:]...)...)...)
+	bad := corruptCRC(t, src, "tEXt")
+	for _, tc := range []struct {
+		ignore, recompute bool
+		wantErr           bool // for bad input
+		wantValid         bool // of tEXt written for bad input
+	}{
+		{false, false, true, false},
+		{false, true, true, false},
+		{true, false, false, false},
+		{true, true, false, true},
+	} {
+		opts := pnglevel.Options{Level: 9, IgnoreInputCRC: tc.ignore, RecomputeOutputCRC: tc.recompute}
+		for _, c := range readChunks(t, repack(t, src, opts)) {
+			if !c.crcOK {
+				t.Errorf("%+v: valid input: invalid checksum of %s", tc, c.typ)
+			}
+		}
+		var out bytes.Buffer
+		err := pnglevel.RepackWithOptions(&out, bytes.NewReader(bad), opts)
+		if tc.wantErr {
+			if !errors.Is(err, pnglevel.ErrBadChecksum) {
+				t.Errorf("%+v: got %v, want ErrBadChecksum", tc, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%+v: %v", tc, err)
+		}
+		for _, c := range readChunks(t, out.Bytes()) {
+			if want := c.typ != "tEXt" || tc.wantValid; c.crcOK != want {
+				t.Errorf("%+v: checksum of %s is valid: %v, want %v", tc, c.typ, c.crcOK, want)
+			}
+		}
+	}
+}
+
+func TestFilterMethod(t *testing.T) {
+	chunks := readChunks(t, encodePNG(t, testImage(8, 8), png.BestSpeed))
+	ihdr := append([]byte(nil), chunks[0].data...)
+	ihdr[11] = 1
+	src := buildPNG(append([]chunk{{typ: "IHDR", data: ihdr}}, chunks[1:]...)...)
+	err := pnglevel.RepackWithOptions(io.Discard, bytes.NewReader(src), pnglevel.Options{Level: 9})
+	if err == nil || !strings.Contains(err.Error(), "unsupported filter method") {
+		t.Errorf("got %v, want unsupported filter method", err)
+	}
+}
+
+func TestLevel(t *testing.T) {
+	src := encodePNG(t, testImage(30, 20), png.BestSpeed)
+	for _, level := range []int{-3, 10} {
+		if _, err := pnglevel.NewReaderWithOptions(bytes.NewReader(src), pnglevel.Options{Level: level}); err == nil {
+			t.Errorf("NewReaderWithOptions accepted level %d", level)
+		}
+		var out bytes.Buffer
+		if err := pnglevel.Repack(&out, bytes.NewReader(src), level); err == nil || out.Len() > 0 {
+			t.Errorf("Repack at level %d: error %v, wrote %d bytes", level, err, out.Len())
+		}
+	}
+	for _, level := range []int{zlib.HuffmanOnly, zlib.DefaultCompression, zlib.NoCompression, zlib.BestSpeed, zlib.BestCompression} {
+		var out bytes.Buffer
+		if err := pnglevel.Repack(&out, bytes.NewReader(src), level); err != nil {
+			t.Errorf("level %d: %v", level, err)
+			continue
+		}
+		samePixels(t, src, out.Bytes())
+	}
+}
+
+func TestRepackBytes(t *testing.T) {
+	src := encodePNG(t, testImage(60, 40), png.BestSpeed)
+	got, err := pnglevel.RepackBytes(src, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := repack(t, src, pnglevel.Options{Level: 9}); !bytes.Equal(got, want) {
+		t.Errorf("output differs from Repack")
+	}
+	if _, err := pnglevel.RepackBytes(corruptCRC(t, src, "IDAT"), 9); !errors.Is(err, pnglevel.ErrBadChecksum) {
+		t.Errorf("got %v, want ErrBadChecksum", err)
+	}
+	if _, err := pnglevel.RepackBytes([]byte("GIF89a\x01\x00\x01\x00"), 9); !errors.Is(err, pnglevel.ErrNotPNG) {
+		t.Errorf("got %v, want ErrNotPNG", err)
+	}
+}
+
+func BenchmarkRepackBytes(b *testing.B) {
+	src := largeImage(b)
+	b.Run("RepackBytes", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := pnglevel.RepackBytes(src, 6); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Repack", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var out bytes.Buffer
+			if err := pnglevel.Repack(&out, bytes.NewReader(src), 6); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestNoFlushPerRead(t *testing.T) {
+	src := encodePNG(t, testImage(400, 300), png.BestSpeed)
+	raw := inflate(t, imageData(t, src))
+	const bufferSize = 1024
+	// Size of image data written by flushing after each read.
+	var flushed bytes.Buffer
+	zw, _ := zlib.NewWriterLevel(&flushed, zlib.BestCompression)
+	for i := 0; i < len(raw); i += bufferSize {
+		zw.Write(raw[i:min(i+bufferSize, len(raw))])
+		zw.Flush()
+	}
+	zw.Close()
+	out := repack(t, src, pnglevel.Options{Level: zlib.BestCompression, BufferSize: bufferSize})
+	samePixels(t, src, out)
+	n := len(imageData(t, out))
+	if n >= flushed.Len()*97/100 || n >= len(imageData(t, src))*9/10 {
+		t.Errorf("got %d bytes of image data; input has %d, flushing after each read gives %d",
+			n, len(imageData(t, src)), flushed.Len())
+	}
+}
+
+func TestCoalesceIDAT(t *testing.T) {
+	clean := encodePNG(t, testImage(100, 60), png.BestSpeed)
+	data := imageData(t, clean)
+	src := splitIDAT(t, clean, len(data)/3+1)
+	if n := strings.Count(fmt.Sprint(chunkTypes(readChunks(t, src))), "IDAT"); n != 3 {
+		t.Fatalf("input has %d IDAT chunks", n)
+	}
+	for _, opts := range []pnglevel.Options{
+		{Level: 9, CoalesceIDAT: true},
+		{Level: 9, CoalesceIDAT: true, BufferSize: 100},
+	} {
+		out := repack(t, src, opts)
+		chunks := readChunks(t, out)
+		if got := fmt.Sprint(chunkTypes(chunks)); got != "[IHDR IDAT IEND]" {
+			t.Errorf("got chunks %s", got)
+		}
+		for _, c := range chunks {
+			if !c.crcOK {
+				t.Errorf("invalid checksum of %s", c.typ)
+			}
+		}
+		if !bytes.Equal(inflate(t, imageData(t, out)), inflate(t, data)) {
+			t.Error("decompressed image data differs")
+		}
+	}
+}
+
+func TestBufferSizeOne(t *testing.T) {
+	clean := encodePNG(t, testImage(40, 30), png.BestSpeed)
+	chunks := readChunks(t, clean)
+	text := chunk{typ: "tEXt", data: []byte("Comment\x00" + strings.Repeat("buffer ", 20))}
+	ztxt := chunk{typ: "zTXt", data: append([]byte("Title\x00\x00"), zlibData(t, []byte("small buffers"), 9)...)}
+	src := splitIDAT(t, buildPNG(append(chunks[:1:1], append([]chunk{text, ztxt}, chunks[1:]...)...)...), 100)
+	for _, opts := range []pnglevel.Options{
+		{Level: 9, BufferSize: 1},
+		{Level: 9, BufferSize: 1, Filter: pnglevel.FilterMinSum},
+		{Level: 9, BufferSize: 1, PreserveIDATLayout: true},
+	} {
+		out := repack(t, src, opts)
+		samePixels(t, clean, out)
+		got := readChunks(t, out)
+		if fmt.Sprint(chunkTypes(got[:3])) != "[IHDR tEXt zTXt]" || !bytes.Equal(got[1].data, text.data) {
+			t.Errorf("%+v: got chunks %v", opts, chunkTypes(got))
+		}
+	}
+}
+
+func TestDict(t *testing.T) {
+	src := encodePNG(t, testImage(80, 50), png.BestSpeed)
+	raw := inflate(t, imageData(t, src))
+	dict := raw[:4096]
+	out := repack(t, src, pnglevel.Options{Level: 9, Dict: dict})
+	zr, err := zlib.NewReaderDict(bytes.NewReader(imageData(t, out)), dict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, raw) {
+		t.Error("image data decompressed with the dictionary differs")
+	}
+	if _, err := png.Decode(bytes.NewReader(out)); err == nil {
+		t.Error("output decodes without the dictionary")
+	}
+	zc := pnglevel.CompressorFunc(func(w io.Writer) (io.WriteCloser, error) { return zlib.NewWriter(w), nil })
+	if _, err := pnglevel.NewReaderWithOptions(bytes.NewReader(src), pnglevel.Options{Level: 9, Dict: dict, Compressor: zc}); err == nil {
+		t.Error("Dict with Compressor accepted")
+	}
+}
+
+// withChunks returns the PNG file b with extra chunks inserted
+// after IHDR.
+func withChunks(t *testing.T, b []byte, extra ...chunk) []byte {
+	t.Helper()
+	chunks := readChunks(t, b)
+	return buildPNG(append(append(chunks[:1:1], extra...), chunks[1:]...)...)
+}
+
+var metadataChunks = []chunk{
+	{typ: "tEXt", data: []byte("Author\x00someone")},
+	{typ: "tIME", data: []byte{0x07, 0xe6, 1, 2, 3, 4, 5}},
+	{typ: "iTXt", data: []byte("Title\x00\x00\x00\x00\x00private")},
+	{typ: "eXIf", data: []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x00\x00\x00\x00\x00")},
+}
+
+func TestKeepChunk(t *testing.T) {
+	pal := image.NewPaletted(image.Rect(0, 0, 30, 20), color.Palette{color.Black, color.White, color.Gray{100}})
+	for i := range pal.Pix {
+		pal.Pix[i] = uint8(i % 3)
+	}
+	for _, m := range []image.Image{testImage(30, 20), pal} {
+		clean := encodePNG(t, m, png.BestSpeed)
+		src := withChunks(t, clean, append(metadataChunks, chunk{typ: "gAMA", data: []byte{0, 0, 0xb1, 0x8f}})...)
+		var seen []string
+		out := repack(t, src, pnglevel.Options{Level: 9, KeepChunk: func(typ string) bool {
+			seen = append(seen, typ)
+			return false
+		}})
+		samePixels(t, clean, out)
+		if got, want := fmt.Sprint(chunkTypes(readChunks(t, out))), fmt.Sprint(chunkTypes(readChunks(t, clean))); got != want {
+			t.Errorf("got chunks %s, want %s; KeepChunk called for %v", got, want, seen)
+		}
+		if bytes.Contains(out, []byte("tEXt")) || bytes.Contains(out, []byte("someone")) {
+			t.Error("tEXt chunk is in the output")
+		}
+		// Dropped chunks are still verified.
+		drop := func(string) bool { return false }
+		if err := pnglevel.RepackWithOptions(io.Discard, bytes.NewReader(corruptCRC(t, src, "tEXt")), pnglevel.Options{Level: 9, KeepChunk: drop}); !errors.Is(err, pnglevel.ErrBadChecksum) {
+			t.Errorf("got %v, want ErrBadChecksum", err)
+		}
+	}
+}
+
+func TestRecompressText(t *testing.T) {
+	var text strings.Builder
+	for i := 0; text.Len() < 8000; i++ {
+		fmt.Fprintf(&text, "line %d of a long comment\n", i)
+	}
+	ztxt := chunk{typ: "zTXt", data: append([]byte("Comment\x00\x00"), zlibData(t, []byte(text.String()), zlib.NoCompression)...)}
+	itxtHead := []byte("Description\x00\x01\x00en\x00Beschreibung\x00")
+	itxt := chunk{typ: "iTXt", data: append(itxtHead, zlibData(t, []byte(text.String()), zlib.NoCompression)...)}
+	plain := chunk{typ: "iTXt", data: []byte("Title\x00\x00\x00\x00\x00uncompressed")}
+	clean := encodePNG(t, testImage(20, 10), png.BestSpeed)
+	out := repack(t, withChunks(t, clean, ztxt, itxt, plain), pnglevel.Options{Level: 9})
+	samePixels(t, clean, out)
+	chunks := readChunks(t, out)
+	if got := fmt.Sprint(chunkTypes(chunks[1:4])); got != "[zTXt iTXt iTXt]" {
+		t.Fatalf("got chunks %v", chunkTypes(chunks))
+	}
+	for i, head := range [][]byte{[]byte("Comment\x00\x00"), itxtHead} {
+		c := chunks[1+i]
+		if !c.crcOK || !bytes.HasPrefix(c.data, head) {
+			t.Fatalf("%s: invalid chunk", c.typ)
+		}
+		if len(c.data) >= len(ztxt.data)/4 {
+			t.Errorf("%s: %d bytes are not recompressed", c.typ, len(c.data))
+		}
+		if string(inflate(t, c.data[len(head):])) != text.String() {
+			t.Errorf("%s: text differs", c.typ)
+		}
+	}
+	if !bytes.Equal(chunks[3].data, plain.data) {
+		t.Error("uncompressed iTXt changed")
+	}
+}
+
+// iccProfile returns an ICC profile of n bytes with a plausible header,
+// tag table, and tone curves.
+func iccProfile(n int) []byte {
+	b := make([]byte, n)
+	binary.BigEndian.PutUint32(b, uint32(n))
+	copy(b[4:], "lcms\x02\x10\x00\x00mntrRGB XYZ ")
+	copy(b[36:], "acspAPPL")
+	binary.BigEndian.PutUint32(b[128:], 3)
+	for i, tag := range []string{"rTRC", "gTRC", "bTRC"} {
+		copy(b[132+12*i:], tag)
+		binary.BigEndian.PutUint32(b[136+12*i:], 168)
+		binary.BigEndian.PutUint32(b[140+12*i:], uint32(n-168))
+	}
+	copy(b[168:], "curv")
+	binary.BigEndian.PutUint32(b[176:], uint32((n-180)/2))
+	for i := 180; i+1 < n; i += 2 {
+		binary.BigEndian.PutUint16(b[i:], uint16((i-180)*(i-180)/n))
+	}
+	return b
+}
+
+func TestRecompressICCP(t *testing.T) {
+	profile := iccProfile(3144)
+	iccp := chunk{typ: "iCCP", data: append([]byte("ICC profile\x00\x00"), zlibData(t, profile, zlib.BestSpeed)...)}
+	clean := encodePNG(t, testImage(20, 10), png.BestSpeed)
+	out := repack(t, withChunks(t, clean, iccp), pnglevel.Options{Level: 9})
+	samePixels(t, clean, out)
+	c := readChunks(t, out)[1]
+	if c.typ != "iCCP" || !c.crcOK || !bytes.HasPrefix(c.data, []byte("ICC profile\x00\x00")) {
+		t.Fatalf("invalid %s chunk", c.typ)
+	}
+	if len(c.data) > len(iccp.data) {
+		t.Errorf("profile grew from %d to %d bytes", len(iccp.data), len(c.data))
+	}
+	if !bytes.Equal(inflate(t, c.data[13:]), profile) {
+		t.Error("profile differs")
+	}
+	bad := chunk{typ: "iCCP", data: append([]byte(nil), iccp.data...)}
+	bad.data[12] = 1
+	err := pnglevel.RepackWithOptions(io.Discard, bytes.NewReader(withChunks(t, clean, bad)), pnglevel.Options{Level: 9})
+	if !errors.Is(err, pnglevel.ErrUnsupportedCompression) {
+		t.Errorf("got %v, want ErrUnsupportedCompression", err)
+	}
+}
+
+// interlacedGray returns an interlaced 8-bit grayscale PNG file of m
+// with unfiltered scanlines.
+func interlacedGray(t *testing.T, m *image.Gray) []byte {
+	t.Helper()
+	w, h := m.Rect.Dx(), m.Rect.Dy()
+	var raw []byte
+	for _, pass := range [][4]int{{0, 0, 8, 8}, {4, 0, 8, 8}, {0, 4, 4, 8}, {2, 0, 4, 4}, {0, 2, 2, 4}, {1, 0, 2, 2}, {0, 1, 1, 2}} {
+		if pass[0] >= w {
+			continue
+		}
+		for y := pass[1]; y < h; y += pass[3] {
+			raw = append(raw, 0)
+			for x := pass[0]; x < w; x += pass[2] {
+				raw = append(raw, m.GrayAt(x, y).Y)
+			}
+		}
+	}
+	return buildPNG(
+		chunk{typ: "IHDR", data: ihdrData(uint32(w), uint32(h), 8, 0, 1)},
+		chunk{typ: "IDAT", data: zlibData(t, raw, zlib.BestSpeed)},
+		chunk{typ: "IEND"},
+	)
+}
+
+func TestRefilter(t *testing.T) {
+	// Scanlines are unfiltered at NoCompression.
+	src := encodePNG(t, testImage(200, 150), png.NoCompression)
+	verbatim := repack(t, src, pnglevel.Options{Level: 9})
+	refiltered := repack(t, src, pnglevel.Options{Level: 9, Filter: pnglevel.FilterMinSum})
+	samePixels(t, src, refiltered)
+	if len(refiltered) >= len(verbatim) {
+		t.Errorf("refiltered output is %d bytes, %d without refiltering", len(refiltered), len(verbatim))
+	}
+
+	// Reduced images of interlaced images are refiltered separately.
+	gray := image.NewGray(image.Rect(0, 0, 13, 11))
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i * 3)
+	}
+	interlaced := interlacedGray(t, gray)
+	out := repack(t, interlaced, pnglevel.Options{Level: 9, Filter: pnglevel.FilterMinSum})
+	samePixels(t, encodePNG(t, gray, png.NoCompression), out)
+	if readChunks(t, out)[0].data[12] != 1 {
+		t.Error("output is not interlaced")
+	}
+}
+
+func TestKeepSmallerTiny(t *testing.T) {
+	src := buildPNG(
+		chunk{typ: "IHDR", data: ihdrData(1, 1, 1, 0, 0)},
+		chunk{typ: "IDAT", data: zlibData(t, []byte{0, 0x80}, zlib.BestCompression)},
+		chunk{typ: "IEND"},
+	)
+	for _, level := range []int{zlib.NoCompression, zlib.BestSpeed, zlib.BestCompression} {
+		out := repack(t, src, pnglevel.Options{Level: level, KeepSmaller: true})
+		if len(out) > len(src) {
+			t.Errorf("level %d: output grew from %d to %d bytes", level, len(src), len(out))
+		}
+		samePixels(t, src, out)
+	}
+	// The stored stream is larger, so the original is kept as is.
+	out := repack(t, src, pnglevel.Options{Level: zlib.NoCompression, KeepSmaller: true})
+	if !bytes.Equal(imageData(t, out), imageData(t, src)) {
+		t.Error("original image data is not kept")
+	}
+}
+
+func TestOnChunk(t *testing.T) {
+	clean := encodePNG(t, testImage(100, 80), png.BestSpeed)
+	text := chunk{typ: "tEXt", data: []byte("Comment\x00progress")}
+	src := splitIDAT(t, withChunks(t, clean, text), 1000)
+	for _, opts := range []pnglevel.Options{
+		{Level: 9},
+		{Level: 9, IDATSize: 500},
+		{Level: 9, BufferSize: 64},
+	} {
+		var calls []string
+		opts.OnChunk = func(kind string, n int) { calls = append(calls, fmt.Sprint(kind, " ", n)) }
+		out := repack(t, src, opts)
+		var want []string
+		for _, c := range readChunks(t, out) {
+			want = append(want, fmt.Sprint(c.typ, " ", len(c.data)))
+		}
+		if fmt.Sprint(calls) != fmt.Sprint(want) {
+			t.Errorf("%+v:\ngot calls  %v\nwant calls %v", opts, calls, want)
+		}
+		if calls[0] != "IHDR 13" || calls[1] != "tEXt 16" || calls[len(calls)-1] != "IEND 0" {
+			t.Errorf("got calls %v", calls)
+		}
+	}
+}
+
+// cancelReader reads from r, calling cancel once n bytes are read.
+type cancelReader struct {
+	r      io.Reader
+	n      int
+	read   int
+	cancel func()
+}
+
+func (r *cancelReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if r.read += n; r.read >= r.n {
+		r.cancel()
+	}
+	return n, err
+}
+
+func TestRepackContext(t *testing.T) {
+	// 256 MB of zero pixels.
+	const size = 16000
+	var z bytes.Buffer
+	zw, err := zlib.NewWriterLevel(&z, zlib.BestSpeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	row := make([]byte, 1+size)
+	for y := 0; y < size; y++ {
+		zw.Write(row)
+	}
+	zw.Close()
+	src := splitIDAT(t, buildPNG(
+		chunk{typ: "IHDR", data: ihdrData(size, size, 8, 0, 0)},
+		chunk{typ: "IDAT", data: z.Bytes()},
+		chunk{typ: "IEND"},
+	), 1000)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := &cancelReader{r: bytes.NewReader(src), n: 1000, cancel: cancel}
+	start := time.Now()
+	err = pnglevel.RepackContext(ctx, io.Discard, r, zlib.BestCompression)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	if r.read > len(src)/2 {
+		t.Errorf("read %d of %d bytes after cancellation in %v", r.read, len(src), time.Since(start))
+	}
+}
+
+func TestReset(t *testing.T) {
+	gray := image.NewGray(image.Rect(0, 0, 50, 30))
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i)
+	}
+	pal := image.NewPaletted(image.Rect(0, 0, 20, 70), color.Palette{color.Black, color.White})
+	for i := range pal.Pix {
+		pal.Pix[i] = uint8(i / 3 % 2)
+	}
+	srcs := [][]byte{
+		encodePNG(t, gray, png.BestSpeed),
+		withChunks(t, encodePNG(t, pal, png.NoCompression), chunk{typ: "tEXt", data: []byte("Comment\x00reset")}),
+		splitIDAT(t, encodePNG(t, testImage(60, 40), png.BestSpeed), 300),
+	}
+	p := pnglevel.NewReader(bytes.NewReader(srcs[2][:500]), 9)
+	if _, err := io.Copy(io.Discard, p); err == nil {
+		t.Fatal("no error for truncated file")
+	}
+	for i, src := range srcs {
+		level := 9 - i
+		p.Reset(bytes.NewReader(src), level)
+		var out bytes.Buffer
+		if _, err := io.Copy(&out, p); err != nil {
+			t.Fatalf("file %d: %v", i, err)
+		}
+		if want := repack(t, src, pnglevel.Options{Level: level}); !bytes.Equal(out.Bytes(), want) {
+			t.Errorf("file %d: output differs from a new Reader", i)
+		}
+	}
+}
+
+// limitWriter accepts n bytes, then fails.
+type limitWriter struct{ n int }
+
+var errLimit = errors.New("write limit")
+
+func (w *limitWriter) Write(b []byte) (int, error) {
+	if len(b) > w.n {
+		n := w.n
+		w.n = 0
+		return n, errLimit
+	}
+	w.n -= len(b)
+	return len(b), nil
+}
+
+func TestWriteTo(t *testing.T) {
+	src := splitIDAT(t, encodePNG(t, testImage(100, 80), png.BestSpeed), 700)
+	for _, opts := range []pnglevel.Options{
+		{Level: 9},
+		{Level: 9, BufferSize: 100},
+		{Level: 9, CoalesceIDAT: true, Filter: pnglevel.FilterMinSum},
+	} {
+		p, err := pnglevel.NewReaderWithOptions(bytes.NewReader(src), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var read bytes.Buffer
+		if _, err := io.Copy(&read, struct{ io.Reader }{p}); err != nil {
+			t.Fatal(err)
+		}
+		p, _ = pnglevel.NewReaderWithOptions(bytes.NewReader(src), opts)
+		var written bytes.Buffer
+		n, err := p.WriteTo(&written)
+		if err != nil || n != int64(written.Len()) {
+			t.Fatalf("WriteTo returned %d, %v; wrote %d bytes", n, err, written.Len())
+		}
+		if !bytes.Equal(read.Bytes(), written.Bytes()) {
+			t.Errorf("%+v: WriteTo output differs from Read output", opts)
+		}
+	}
+	p := pnglevel.NewReader(bytes.NewReader(src), 9)
+	if n, err := p.WriteTo(&limitWriter{n: 1000}); n != 1000 || err != errLimit {
+		t.Errorf("got %d, %v; want 1000, %v", n, err, errLimit)
+	}
+}
+
+func BenchmarkWriteTo(b *testing.B) {
+	src := largeImage(b)
+	b.Run("WriteTo", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			p := pnglevel.NewReader(bytes.NewReader(src), 6)
+			if _, err := io.Copy(io.Discard, p); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Read", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			p := pnglevel.NewReader(bytes.NewReader(src), 6)
+			if _, err := io.Copy(io.Discard, struct{ io.Reader }{p}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestCounts(t *testing.T) {
+	src := splitIDAT(t, withChunks(t, encodePNG(t, testImage(100, 80), png.BestSpeed), chunk{typ: "tEXt", data: []byte("Comment\x00counts")}), 500)
+	for _, writeTo := range []bool{false, true} {
+		p := pnglevel.NewReader(bytes.NewReader(src), 9)
+		var out bytes.Buffer
+		var err error
+		if writeTo {
+			_, err = p.WriteTo(&out)
+		} else {
+			_, err = io.Copy(&out, struct{ io.Reader }{p})
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if in, n := p.Counts(); in != int64(len(src)) || n != int64(out.Len()) {
+			t.Errorf("WriteTo %v: got counts %d, %d; want %d, %d", writeTo, in, n, len(src), out.Len())
+		}
+	}
+}
+
+func TestMaxDecompressedSize(t *testing.T) {
+	// 16 MB of zero pixels in a stream of a few kilobytes.
+	const size = 4000
+	raw := make([]byte, size*(size+1))
+	src := buildPNG(
+		chunk{typ: "IHDR", data: ihdrData(size, size, 8, 0, 0)},
+		chunk{typ: "IDAT", data: zlibData(t, raw, zlib.BestCompression)},
+		chunk{typ: "IEND"},
+	)
+	for _, opts := range []pnglevel.Options{
+		{Level: 1, MaxDecompressedSize: 1 << 20},
+		{Level: 1, MaxDecompressedSize: 1 << 20, BufferSize: 1 << 22},
+		{Level: 1, MaxDecompressedSize: int64(len(raw)) - 1, Pipeline: true},
+	} {
+		err := pnglevel.RepackWithOptions(io.Discard, bytes.NewReader(src), opts)
+		if !errors.Is(err, pnglevel.ErrDecompressedTooLarge) {
+			t.Errorf("%+v: got %v, want ErrDecompressedTooLarge", opts, err)
+		}
+	}
+	if err := pnglevel.RepackWithOptions(io.Discard, bytes.NewReader(src), pnglevel.Options{Level: 1, MaxDecompressedSize: int64(len(raw))}); err != nil {
+		t.Errorf("limit of the exact size: %v", err)
+	}
+}
+
+func TestRepairChecksums(t *testing.T) {
+	clean := withChunks(t, encodePNG(t, testImage(60, 40), png.BestSpeed), chunk{typ: "tEXt", data: []byte("Comment\x00bad crc")})
+	src := splitIDAT(t, clean, 400)
+	for _, typ := range []string{"IHDR", "tEXt", "IDAT", "IEND"} {
+		src = corruptCRC(t, src, typ)
+	}
+	if err := pnglevel.RepackWithOptions(io.Discard, bytes.NewReader(src), pnglevel.Options{Level: 9}); !errors.Is(err, pnglevel.ErrBadChecksum) {
+		t.Errorf("without Repair: got %v, want ErrBadChecksum", err)
+	}
+	for _, opts := range []pnglevel.Options{
+		{Level: 9, Repair: true},
+		{Level: 9, Repair: true, BufferSize: 100},
+		{Level: 9, Repair: true, PreserveIDATLayout: true},
+	} {
+		out := repack(t, src, opts)
+		for _, c := range readChunks(t, out) {
+			if !c.crcOK {
+				t.Errorf("%+v: invalid checksum of %s", opts, c.typ)
+			}
+		}
+		samePixels(t, clean, out)
+	}
+}
+
+func TestSentinelErrors(t *testing.T) {
+	clean := encodePNG(t, testImage(20, 10), png.BestSpeed)
+	chunks := readChunks(t, clean)
+	ihdr, idat := chunks[0], chunk{typ: "IDAT", data: imageData(t, clean)}
+	iend := chunk{typ: "IEND"}
+	text := chunk{typ: "tEXt", data: []byte("Comment\x00sentinel")}
+	withIHDR := func(f func(b []byte)) chunk {
+		b := append([]byte(nil), ihdr.data...)
+		f(b)
+		return chunk{typ: "IHDR", data: b}
+	}
+	tooBig := buildPNG(ihdr)
+	tooBig = append(tooBig, 0x80, 0, 0, 0, 't', 'E', 'X', 't')
+	for _, tc := range []struct {
+		name string
+		src  []byte
+		want error
+	}{
+		{"not PNG", []byte("GIF89a\x01\x00\x01\x00\x00\x00"), pnglevel.ErrNotPNG},
+		{"missing IHDR", buildPNG(text, ihdr, idat, iend), pnglevel.ErrMissingIHDR},
+		{"IHDR length", buildPNG(chunk{typ: "IHDR", data: ihdr.data[:12]}, idat, iend), pnglevel.ErrBadIHDRLength},
+		{"compression method", buildPNG(withIHDR(func(b []byte) { b[10] = 1 }), idat, iend), pnglevel.ErrUnsupportedCompression},
+		{"zTXt compression method", buildPNG(ihdr, chunk{typ: "zTXt", data: []byte("Comment\x00\x01x")}, idat, iend), pnglevel.ErrUnsupportedCompression},
+		{"tEXt checksum", corruptCRC(t, buildPNG(ihdr, text, idat, iend), "tEXt"), pnglevel.ErrBadChecksum},
+		{"IDAT checksum", corruptCRC(t, clean, "IDAT"), pnglevel.ErrBadChecksum},
+		{"chunk too big", tooBig, pnglevel.ErrChunkTooBig},
+		{"IDAT order", buildPNG(ihdr, idat, text, chunk{typ: "IDAT", data: []byte{0}}, iend), pnglevel.ErrWrongIDATOrder},
+		{"missing IEND", buildPNG(ihdr, idat), pnglevel.ErrMissingIEND},
+		{"no image data", buildPNG(ihdr, iend), pnglevel.ErrNoImageData},
+	} {
+		err := pnglevel.RepackWithOptions(io.Discard, bytes.NewReader(tc.src), pnglevel.Options{Level: 9})
+		if !errors.Is(err, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestChunkAfterIDAT(t *testing.T) {
+	const iend = "\x00\x00\x00\x00IEND\xae\x42\x60\x82"
+	ihdr := chunk{typ: "IHDR", data: ihdrData(1, 1, 8, 0, 0)}
+	idat := chunk{typ: "IDAT", data: zlibData(t, []byte{0, 0x7f}, zlib.BestSpeed)}
+	src := buildPNG(ihdr, idat, chunk{typ: "IEND"})
+	for _, tc := range []struct {
+		name string
+		src  []byte
+	}{
+		{"IEND", src},
+		{"tEXt", buildPNG(ihdr, idat, chunk{typ: "tEXt", data: []byte("Comment\x00after")}, chunk{typ: "IEND"})},
+	} {
+		out := repack(t, tc.src, pnglevel.Options{Level: 9})
+		if !bytes.HasSuffix(out, []byte(iend)) {
+			t.Errorf("%s: output ends with % x", tc.name, out[len(out)-12:])
+		}
+		if got, want := fmt.Sprint(chunkTypes(readChunks(t, out))), fmt.Sprint(chunkTypes(readChunks(t, tc.src))); got != want {
+			t.Errorf("%s: got chunks %s, want %s", tc.name, got, want)
+		}
+		samePixels(t, src, out)
+	}
+}
+
+// eofReader returns data a few bytes at a time, with io.EOF
+// along with the last bytes.
+type eofReader struct {
+	b []byte
+	n int
+}
+
+func (r *eofReader) Read(b []byte) (int, error) {
+	n := copy(b, r.b[:min(r.n, len(r.b))])
+	r.b = r.b[n:]
+	if len(r.b) == 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func TestDataWithEOF(t *testing.T) {
+	src := splitIDAT(t, encodePNG(t, testImage(40, 30), png.BestSpeed), 300)
+	src = withChunks(t, src, chunk{typ: "tEXt", data: []byte("Comment\x00data with EOF")})
+	for _, opts := range []pnglevel.Options{
+		{Level: 9},
+		{Level: 9, BufferSize: 7},
+		{Level: 9, Repair: true},
+	} {
+		want := repack(t, src, opts)
+		for _, n := range []int{1, 5, len(src)} {
+			var out bytes.Buffer
+			if err := pnglevel.RepackWithOptions(&out, &eofReader{src, n}, opts); err != nil {
+				t.Fatalf("%d bytes per read: %v", n, err)
+			}
+			if !bytes.Equal(out.Bytes(), want) {
+				t.Errorf("%d bytes per read: output differs", n)
+			}
+		}
+	}
+	chunks, err := pnglevel.ListChunks(&eofReader{src, 1})
+	if err != nil || len(chunks) != len(readChunks(t, src)) {
+		t.Errorf("ListChunks: got %d chunks, %v", len(chunks), err)
+	}
+}
+
+func TestRequireIEND(t *testing.T) {
+	src := encodePNG(t, testImage(40, 30), png.BestSpeed)
+	noEnd := src[:len(src)-12]
+	garbage := append(append([]byte(nil), src...), "junk"...)
+	afterEnd := buildPNG(append(readChunks(t, src), chunk{typ: "tEXt", data: []byte("Comment\x00after IEND")})...)
+	nonEmpty := buildPNG(append(readChunks(t, noEnd), chunk{typ: "IEND", data: []byte{0}})...)
+	for _, opts := range []pnglevel.Options{
+		{Level: 9, RequireIEND: true},
+		{Level: 9, RequireIEND: true, Filter: pnglevel.FilterMinSum},
+	} {
+		samePixels(t, src, repack(t, src, opts))
+		if err := pnglevel.RepackWithOptions(io.Discard, bytes.NewReader(noEnd), opts); !errors.Is(err, pnglevel.ErrMissingIEND) {
+			t.Errorf("no IEND: got %v, want ErrMissingIEND", err)
+		}
+		for name, b := range map[string][]byte{"trailing garbage": garbage, "chunk after IEND": afterEnd, "non-empty IEND": nonEmpty} {
+			if err := pnglevel.RepackWithOptions(io.Discard, bytes.NewReader(b), opts); err == nil {
+				t.Errorf("%s: no error", name)
+			}
+		}
+	}
+	// Only NewChunkReader is lenient without the option.
+	p, err := pnglevel.NewChunkReader(bytes.NewReader(noEnd[8+25:]), pnglevel.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(io.Discard, p); err != nil {
+		t.Errorf("NewChunkReader: %v", err)
+	}
+}
+
+func TestListChunks(t *testing.T) {
+	src := buildPNG(
+		chunk{typ: "IHDR", data: ihdrData(1, 1, 8, 0, 0)},
+		chunk{typ: "gAMA", data: []byte{0, 0, 0xb1, 0x8f}},
+		chunk{typ: "IDAT", data: []byte("not even zlib")},
+		chunk{typ: "IDAT"},
+		chunk{typ: "IEND"},
+	)
+	src = corruptCRC(t, src, "gAMA")
+	src = append(src, "ignored after IEND"...)
+	chunks, err := pnglevel.ListChunks(bytes.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []pnglevel.ChunkInfo{
+		{Type: "IHDR", Length: 13, CRCValid: true, Offset: 8},
+		{Type: "gAMA", Length: 4, CRCValid: false, Offset: 33},
+		{Type: "IDAT", Length: 13, CRCValid: true, Offset: 49},
+		{Type: "IDAT", Length: 0, CRCValid: true, Offset: 74},
+		{Type: "IEND", Length: 0, CRCValid: true, Offset: 86},
+	}
+	if fmt.Sprint(chunks) != fmt.Sprint(want) {
+		t.Errorf("got  %v\nwant %v", chunks, want)
+	}
+	var types []string
+	err = pnglevel.Scan(bytes.NewReader(src), func(typ string, length int, crcOK bool) error {
+		types = append(types, fmt.Sprint(typ, " ", length, " ", crcOK))
+		return nil
+	})
+	if err != nil || fmt.Sprint(types) != "[IHDR 13 true gAMA 4 false IDAT 13 true IDAT 0 true IEND 0 true]" {
+		t.Errorf("Scan: got %v, %v", types, err)
+	}
+}
+
+func TestInsertChunks(t *testing.T) {
+	clean := withChunks(t, encodePNG(t, testImage(40, 30), png.BestSpeed), chunk{typ: "gAMA", data: []byte{0, 0, 0xb1, 0x8f}})
+	src := splitIDAT(t, clean, 300)
+	phys := pnglevel.Chunk{Type: "pHYs", Data: []byte{0, 0, 0x0b, 0x13, 0, 0, 0x0b, 0x13, 1}}
+	text := pnglevel.Chunk{Type: "tEXt", Data: []byte("Copyright\x00someone")}
+	out := repack(t, src, pnglevel.Options{Level: 9, InsertChunks: []pnglevel.Chunk{text, phys}})
+	samePixels(t, clean, out)
+	chunks := readChunks(t, out)
+	types := fmt.Sprint(chunkTypes(chunks))
+	if !strings.HasPrefix(types, "[IHDR gAMA pHYs IDAT") || !strings.HasSuffix(types, "IDAT tEXt IEND]") {
+		t.Errorf("got chunks %s", types)
+	}
+	for _, c := range chunks {
+		if !c.crcOK {
+			t.Errorf("invalid checksum of %s", c.typ)
+		}
+		if c.typ == "tEXt" && !bytes.Equal(c.data, text.Data) || c.typ == "pHYs" && !bytes.Equal(c.data, phys.Data) {
+			t.Errorf("%s data differs", c.typ)
+		}
+	}
+	// The rest of the file is unchanged.
+	if want := repack(t, src, pnglevel.Options{Level: 9}); len(out) != len(want)+12+len(text.Data)+12+len(phys.Data) {
+		t.Errorf("got %d bytes, want %d bytes with inserted chunks", len(out), len(want))
+	}
+	for _, typ := range []string{"IHDR", "PLTE", "IDAT", "IEND"} {
+		opts := pnglevel.Options{Level: 9, InsertChunks: []pnglevel.Chunk{{Type: typ}}}
+		if _, err := pnglevel.NewReaderWithOptions(bytes.NewReader(src), opts); err == nil {
+			t.Errorf("inserting %s: no error", typ)
+		}
+	}
+}
+
+func TestHeader(t *testing.T) {
+	gray16 := image.NewGray16(image.Rect(0, 0, 7, 3))
+	pal := image.NewPaletted(image.Rect(0, 0, 5, 9), color.Palette{color.Black, color.White})
+	nrgba := image.NewNRGBA(image.Rect(0, 0, 11, 2))
+	nrgba.Pix[3] = 100
+	for _, tc := range []struct {
+		src  []byte
+		want pnglevel.IHDR
+	}{
+		{encodePNG(t, gray16, png.BestSpeed), pnglevel.IHDR{Width: 7, Height: 3, BitDepth: 16, ColorType: 0}},
+		{encodePNG(t, pal, png.BestSpeed), pnglevel.IHDR{Width: 5, Height: 9, BitDepth: 1, ColorType: 3}},
+		{encodePNG(t, nrgba, png.BestSpeed), pnglevel.IHDR{Width: 11, Height: 2, BitDepth: 8, ColorType: 6}},
+		{encodePNG(t, testImage(30, 20), png.BestSpeed), pnglevel.IHDR{Width: 30, Height: 20, BitDepth: 8, ColorType: 2}},
+		{interlacedGray(t, image.NewGray(image.Rect(0, 0, 4, 4))), pnglevel.IHDR{Width: 4, Height: 4, BitDepth: 8, ColorType: 0, Interlace: 1}},
+	} {
+		if h, err := pnglevel.ReadIHDR(bytes.NewReader(tc.src)); err != nil || h != tc.want {
+			t.Errorf("ReadIHDR: got %+v, %v; want %+v", h, err, tc.want)
+		}
+		p := pnglevel.NewReader(bytes.NewReader(tc.src), 9)
+		if _, err := p.Header(); err == nil {
+			t.Error("Header: no error before Read")
+		}
+		if _, err := p.Read(make([]byte, 1)); err != nil {
+			t.Fatal(err)
+		}
+		if h, err := p.Header(); err != nil || h != tc.want {
+			t.Errorf("Header: got %+v, %v; want %+v", h, err, tc.want)
+		}
+	}
+	if _, err := pnglevel.ReadIHDR(bytes.NewReader(corruptCRC(t, encodePNG(t, pal, png.BestSpeed), "IHDR"))); !errors.Is(err, pnglevel.ErrBadChecksum) {
+		t.Errorf("got %v, want ErrBadChecksum", err)
+	}
+}
+
+func TestRepackAll(t *testing.T) {
+	dir := t.TempDir()
+	var names []string
+	var srcs [][]byte
+	for i := 0; i < 5; i++ {
+		src := encodePNG(t, testImage(60+i*10, 40), png.NoCompression)
+		if i == 2 {
+			src = corruptCRC(t, src, "IDAT")
+		}
+		path := filepath.Join(dir, fmt.Sprintf("%d.png", i))
+		if err := os.WriteFile(path, src, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, path)
+		srcs = append(srcs, src)
+	}
+	errs := pnglevel.RepackAll(names, 9, 2)
+	if len(errs) != len(names) {
+		t.Fatalf("got %d errors for %d files", len(errs), len(names))
+	}
+	for i, name := range names {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 2 {
+			if !errors.Is(errs[i], pnglevel.ErrBadChecksum) || !bytes.Equal(b, srcs[i]) {
+				t.Errorf("invalid file: got %v, changed: %v", errs[i], !bytes.Equal(b, srcs[i]))
+			}
+			continue
+		}
+		if errs[i] != nil {
+			t.Errorf("file %d: %v", i, errs[i])
+			continue
+		}
+		if len(b) >= len(srcs[i]) {
+			t.Errorf("file %d is not recompressed", i)
+		}
+		samePixels(t, srcs[i], b)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != len(names) {
+		t.Errorf("%d files in the directory, want %d", len(files), len(names))
+	}
+}
+
+func TestCloseMidStream(t *testing.T) {
+	src := encodePNG(t, testImage(100, 80), png.BestSpeed)
+	for _, n := range []int{0, 10, 100, 1000} {
+		for _, opts := range []pnglevel.Options{
+			{Level: 9, BufferSize: 256},
+			{Level: 9, BufferSize: 256, KeepSmaller: true},
+			{Level: 9, BufferSize: 256, Filter: pnglevel.FilterMinSum},
+		} {
+			p, err := pnglevel.NewReaderWithOptions(bytes.NewReader(src), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.ReadFull(p, make([]byte, n)); err != nil {
+				t.Fatal(err)
+			}
+			if err := p.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := p.Read(make([]byte, 100)); err == nil {
+				t.Errorf("%+v: Read after %d bytes and Close: no error", opts, n)
+			}
+			if _, err := p.WriteTo(io.Discard); err == nil {
+				t.Errorf("%+v: WriteTo after %d bytes and Close: no error", opts, n)
+			}
+			p.Close()
+		}
+	}
+}
+
+func TestPreserveIDATLayout(t *testing.T) {
+	clean := encodePNG(t, testImage(60, 40), png.NoCompression)
+	z := zlibData(t, inflate(t, imageData(t, clean)), zlib.NoCompression)
+	chunks := readChunks(t, clean)
+	src := buildPNG(chunks[0],
+		chunk{typ: "IDAT", data: z[:1000]},
+		chunk{typ: "IDAT", data: z[1000:4321]},
+		chunk{typ: "IDAT", data: z[4321:]},
+		chunk{typ: "IEND"},
+	)
+	idatSizes := func(b []byte) (sizes []int) {
+		for _, c := range readChunks(t, b) {
+			if c.typ == "IDAT" {
+				sizes = append(sizes, len(c.data))
+			}
+		}
+		return sizes
+	}
+	want := idatSizes(src)
+	for _, bufferSize := range []int{0, 100} {
+		out := repack(t, src, pnglevel.Options{Level: zlib.NoCompression, PreserveIDATLayout: true, BufferSize: bufferSize})
+		if got := idatSizes(out); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("buffer size %d: got IDAT sizes %v, want %v", bufferSize, got, want)
+		}
+		samePixels(t, clean, out)
+	}
+	// Shorter data fills fewer chunks of the same sizes.
+	got := idatSizes(repack(t, src, pnglevel.Options{Level: zlib.BestCompression, PreserveIDATLayout: true}))
+	for i := range got[:len(got)-1] {
+		if got[i] != want[i] {
+			t.Errorf("level 9: got IDAT sizes %v, input sizes %v", got, want)
+			break
+		}
+	}
+}
+
+func TestMaxOutputSize(t *testing.T) {
+	src := encodePNG(t, testImage(200, 150), png.BestCompression)
+	limit := int64(len(src))
+	for _, opts := range []pnglevel.Options{
+		{Level: zlib.NoCompression, MaxOutputSize: limit},
+		{Level: zlib.NoCompression, MaxOutputSize: limit, BufferSize: 100},
+		{Level: zlib.NoCompression, MaxOutputSize: limit, CoalesceIDAT: true},
+	} {
+		p, err := pnglevel.NewReaderWithOptions(bytes.NewReader(src), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := io.Copy(io.Discard, p)
+		if !errors.Is(err, pnglevel.ErrOutputTooLarge) {
+			t.Errorf("%+v: got %v, want ErrOutputTooLarge", opts, err)
+		}
+		if n > limit {
+			t.Errorf("%+v: returned %d bytes over the limit of %d", opts, n, limit)
+		}
+	}
+	// The original image data is kept within the limit.
+	out := repack(t, src, pnglevel.Options{Level: zlib.NoCompression, MaxOutputSize: limit, KeepSmaller: true})
+	samePixels(t, src, out)
+}
+
+func BenchmarkPipeline(b *testing.B) {
+	src := largeImage(b)
+	for _, pipeline := range []bool{false, true} {
+		b.Run(fmt.Sprint("Pipeline=", pipeline), func(b *testing.B) {
+			opts := pnglevel.Options{Level: 6, Pipeline: pipeline}
+			b.SetBytes(int64(len(src)))
+			for i := 0; i < b.N; i++ {
+				if err := pnglevel.RepackWithOptions(io.Discard, bytes.NewReader(src), opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestErrorOffset(t *testing.T) {
+	clean := encodePNG(t, testImage(40, 30), png.BestSpeed)
+	text := chunk{typ: "tEXt", data: []byte("Comment\x00offset")}
+	src := withChunks(t, clean, text)
+	textEnd := int64(33 + 12 + len(text.data))
+	for _, tc := range []struct {
+		src        []byte
+		typ        string
+		start, end int64
+	}{
+		{corruptCRC(t, src, "tEXt"), "tEXt", 33, textEnd},
+		{corruptCRC(t, src, "IDAT"), "IDAT", textEnd, int64(len(src)) - 12},
+	} {
+		for _, opts := range []pnglevel.Options{{Level: 9}, {Level: 9, Pipeline: true}, {Level: 9, BufferSize: 10}} {
+			err := pnglevel.RepackWithOptions(io.Discard, bytes.NewReader(tc.src), opts)
+			var e *pnglevel.Error
+			if !errors.As(err, &e) || !errors.Is(err, pnglevel.ErrBadChecksum) {
+				t.Fatalf("got %v, want *Error with ErrBadChecksum", err)
+			}
+			if e.ChunkType != tc.typ || e.Offset <= tc.start || e.Offset > tc.end {
+				t.Errorf("%+v: got %s chunk at offset %d, want %s chunk in (%d, %d]", opts, e.ChunkType, e.Offset, tc.typ, tc.start, tc.end)
+			}
+		}
+	}
+}
+
+func TestCanonicalize(t *testing.T) {
+	pal := image.NewPaletted(image.Rect(0, 0, 20, 10), color.Palette{color.Transparent, color.White, color.Black})
+	for i := range pal.Pix {
+		pal.Pix[i] = uint8(i % 3)
+	}
+	clean := encodePNG(t, pal, png.BestSpeed)
+	byType := map[string]chunk{
+		"gAMA": {typ: "gAMA", data: []byte{0, 0, 0xb1, 0x8f}},
+		"pHYs": {typ: "pHYs", data: []byte{0, 0, 0x0b, 0x13, 0, 0, 0x0b, 0x13, 1}},
+		"bKGD": {typ: "bKGD", data: []byte{1}},
+		"tEXt": {typ: "tEXt", data: []byte("Comment\x00canonical")},
+		"tIME": {typ: "tIME", data: []byte{0x07, 0xe6, 1, 2, 3, 4, 5}},
+	}
+	for _, c := range readChunks(t, clean) {
+		byType[c.typ] = c
+	}
+	var src []chunk
+	for _, typ := range []string{"IHDR", "tEXt", "PLTE", "gAMA", "tRNS", "IDAT", "pHYs", "bKGD", "tIME", "IEND"} {
+		src = append(src, byType[typ])
+	}
+	for _, opts := range []pnglevel.Options{
+		{Level: 9, Canonicalize: true},
+		{Level: 9, Canonicalize: true, IDATSize: 100},
+	} {
+		out := repack(t, buildPNG(src...), opts)
+		samePixels(t, clean, out)
+		var types []string
+		for _, c := range readChunks(t, out) {
+			if !c.crcOK {
+				t.Errorf("invalid checksum of %s", c.typ)
+			}
+			if n := len(types); n == 0 || types[n-1] != c.typ {
+				types = append(types, c.typ)
+			}
+		}
+		if got := fmt.Sprint(types); got != "[IHDR gAMA PLTE tRNS pHYs bKGD IDAT tEXt tIME IEND]" {
+			t.Errorf("%+v: got chunks %s", opts, got)
+		}
+	}
+}
+
+func TestOptimize(t *testing.T) {
+	for _, src := range [][]byte{
+		encodePNG(t, testImage(120, 80), png.NoCompression),
+		encodePNG(t, testImage(120, 80), png.BestCompression),
+		buildPNG(
+			chunk{typ: "IHDR", data: ihdrData(1, 1, 1, 0, 0)},
+			chunk{typ: "IDAT", data: zlibData(t, []byte{0, 0x80}, zlib.BestCompression)},
+			chunk{typ: "IEND"},
+		),
+	} {
+		var out bytes.Buffer
+		level, err := pnglevel.Optimize(&out, bytes.NewReader(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.Len() > len(src) {
+			t.Errorf("output grew from %d to %d bytes", len(src), out.Len())
+		}
+		for _, l := range []int{zlib.HuffmanOnly, zlib.BestSpeed, 4, zlib.BestCompression} {
+			if n := len(repack(t, src, pnglevel.Options{Level: l})); n < out.Len() {
+				t.Errorf("level %d gives %d bytes, Optimize chose level %d with %d bytes", l, n, level, out.Len())
+			}
+		}
+		samePixels(t, src, out.Bytes())
+		// The chosen level is reported.
+		var one bytes.Buffer
+		if got, err := pnglevel.Optimize(&one, bytes.NewReader(src), level); err != nil || got != level || !bytes.Equal(one.Bytes(), out.Bytes()) {
+			t.Errorf("Optimize with level %d: got level %d, %v, same output: %v", level, got, err, bytes.Equal(one.Bytes(), out.Bytes()))
+		}
+	}
+}
+
+func TestIDATFraming(t *testing.T) {
+	src := encodePNG(t, testImage(100, 80), png.BestSpeed)
+	for _, opts := range []pnglevel.Options{{Level: 9}, {Level: 9, IDATSize: 100}, {Level: 9, BufferSize: 64}} {
+		out := repack(t, src, opts)
+		// Lengths and checksums are the ones buildPNG computes.
+		if !bytes.Equal(out, buildPNG(readChunks(t, out)...)) {
+			t.Errorf("%+v: IDAT chunks are framed incorrectly", opts)
+		}
+		samePixels(t, src, out)
+	}
+}
+
+// BenchmarkManyIDAT repacks a large image into many small IDAT chunks.
+func BenchmarkManyIDAT(b *testing.B) {
+	src := largeImage(b)
+	opts := pnglevel.Options{Level: 1, IDATSize: 256}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(src)))
+	for i := 0; i < b.N; i++ {
+		if err := pnglevel.RepackWithOptions(io.Discard, bytes.NewReader(src), opts); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestWindowBits(t *testing.T) {
+	src := encodePNG(t, testImage(80, 60), png.BestSpeed)
+	for _, bits := range []int{8, 12, 14, 15} {
+		for _, level := range []int{zlib.NoCompression, zlib.BestCompression} {
+			out := repack(t, src, pnglevel.Options{Level: level, WindowBits: bits})
+			z := imageData(t, out)
+			if got := int(z[0]>>4) + 8; got != bits {
+				t.Errorf("window bits %d, level %d: zlib header declares %d", bits, level, got)
+			}
+			if (uint(z[0])<<8|uint(z[1]))%31 != 0 {
+				t.Errorf("window bits %d, level %d: invalid zlib header check bits", bits, level)
+			}
+			samePixels(t, src, out)
+		}
+	}
+	for _, bits := range []int{-1, 7, 16} {
+		if _, err := pnglevel.NewReaderWithOptions(bytes.NewReader(src), pnglevel.Options{Level: 9, WindowBits: bits}); err == nil {
+			t.Errorf("window bits %d accepted", bits)
+		}
+	}
+}
+
+func TestRawImageData(t *testing.T) {
+	src := encodePNG(t, testImage(60, 40), png.BestSpeed)
+	want := inflate(t, imageData(t, src))
+	for _, b := range [][]byte{src, splitIDAT(t, src, 100), withChunks(t, src, chunk{typ: "tEXt", data: []byte("Comment\x00raw")})} {
+		r, err := pnglevel.RawImageData(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("got %d bytes of image data, want %d", len(got), len(want))
+		}
+	}
+	r, err := pnglevel.RawImageData(bytes.NewReader(corruptCRC(t, splitIDAT(t, src, 100), "IDAT")))
+	if err == nil {
+		_, err = io.ReadAll(r)
+	}
+	if !errors.Is(err, pnglevel.ErrBadChecksum) {
+		t.Errorf("got %v, want ErrBadChecksum", err)
+	}
+}
+
+func TestStripAnimation(t *testing.T) {
+	images := []*image.RGBA{testImage(30, 20), testImage(30, 20), testImage(30, 20)}
+	for i, m := range images {
+		for j := range m.Pix {
+			m.Pix[j] += uint8(i * 70)
+		}
+	}
+	want := encodePNG(t, images[0], png.BestSpeed)
+	apng := buildAPNG(t, images, 1, 200)
+	// A hidden default image isn't a frame: it has no fcTL.
+	var hidden []chunk
+	for _, c := range readChunks(t, apng) {
+		if c.typ == "fcTL" && len(hidden) > 0 && hidden[len(hidden)-1].typ == "acTL" {
+			continue
+		}
+		hidden = append(hidden, c)
+	}
+	for name, src := range map[string][]byte{"default frame": apng, "hidden default image": buildPNG(hidden...)} {
+		out := repack(t, src, pnglevel.Options{Level: 9, StripAnimation: true})
+		if got := fmt.Sprint(chunkTypes(readChunks(t, out))); got != "[IHDR IDAT IEND]" {
+			t.Errorf("%s: got chunks %s", name, got)
+		}
+		samePixels(t, want, out)
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	clean := encodePNG(t, testImage(30, 20), png.BestSpeed)
+	keep := []chunk{
+		{typ: "sRGB", data: []byte{0}},
+		{typ: "gAMA", data: []byte{0, 0, 0xb1, 0x8f}},
+	}
+	src := withChunks(t, clean, append(append(keep, metadataChunks...),
+		chunk{typ: "zTXt", data: append([]byte("Comment\x00\x00"), zlibData(t, []byte("secret"), 9)...)},
+		chunk{typ: "prVt", data: []byte("private data")},
+		chunk{typ: "tEXt", data: []byte("Software\x00something")},
+	)...)
+	var out bytes.Buffer
+	if err := pnglevel.Sanitize(&out, bytes.NewReader(src), 9); err != nil {
+		t.Fatal(err)
+	}
+	chunks := readChunks(t, out.Bytes())
+	if got := fmt.Sprint(chunkTypes(chunks)); got != "[IHDR sRGB gAMA IDAT IEND]" {
+		t.Errorf("got chunks %s", got)
+	}
+	if !bytes.Equal(chunks[1].data, keep[0].data) {
+		t.Error("sRGB data changed")
+	}
+	samePixels(t, clean, out.Bytes())
+}
+
+func TestSetDPI(t *testing.T) {
+	clean := encodePNG(t, testImage(30, 20), png.BestSpeed)
+	old := chunk{typ: "pHYs", data: []byte{0, 0, 0x0b, 0x13, 0, 0, 0x0b, 0x13, 1}}
+	for name, src := range map[string][]byte{"no pHYs": clean, "pHYs": withChunks(t, clean, old, old)} {
+		out := repack(t, src, pnglevel.Options{Level: 9, SetDPI: 300})
+		samePixels(t, clean, out)
+		var phys []chunk
+		for _, c := range readChunks(t, out) {
+			if c.typ == "pHYs" {
+				phys = append(phys, c)
+			}
+		}
+		if len(phys) != 1 || !phys[0].crcOK || len(phys[0].data) != 9 {
+			t.Fatalf("%s: got %d pHYs chunks", name, len(phys))
+		}
+		x, y := binary.BigEndian.Uint32(phys[0].data), binary.BigEndian.Uint32(phys[0].data[4:])
+		// 300 / 0.0254 = 11811.02
+		if x != 11811 || y != 11811 || phys[0].data[8] != 1 {
+			t.Errorf("%s: got %d×%d pixels per unit %d", name, x, y, phys[0].data[8])
+		}
+		if dpi := float64(x) * 0.0254; dpi < 299.99 || dpi > 300.01 {
+			t.Errorf("%s: decoded %g DPI", name, dpi)
+		}
+	}
+}
+
+func TestChunkSink(t *testing.T) {
+	src := splitIDAT(t, withChunks(t, encodePNG(t, testImage(60, 40), png.BestSpeed), chunk{typ: "tEXt", data: []byte("Comment\x00sink")}), 300)
+	errSink := errors.New("sink error")
+	for _, opts := range []pnglevel.Options{
+		{Level: 9},
+		{Level: 9, IDATSize: 200},
+		{Level: 9, CoalesceIDAT: true, KeepSmaller: true},
+	} {
+		want := repack(t, src, opts)
+		rebuilt := []byte("\x89PNG\r\n\x1a\n")
+		opts.ChunkSink = func(kind string, data []byte, crc uint32) error {
+			var b [4]byte
+			binary.BigEndian.PutUint32(b[:], uint32(len(data)))
+			rebuilt = append(append(append(rebuilt, b[:]...), kind...), data...)
+			binary.BigEndian.PutUint32(b[:], crc)
+			rebuilt = append(rebuilt, b[:]...)
+			return nil
+		}
+		var out bytes.Buffer
+		if err := pnglevel.RepackWithOptions(&out, bytes.NewReader(src), opts); err != nil {
+			t.Fatal(err)
+		}
+		if out.Len() != 0 {
+			t.Errorf("%d bytes written to output", out.Len())
+		}
+		if !bytes.Equal(rebuilt, want) {
+			t.Errorf("file built from ChunkSink calls differs from output")
+		}
+		opts.ChunkSink = func(kind string, data []byte, crc uint32) error {
+			if kind == "IDAT" {
+				return errSink
+			}
+			return nil
+		}
+		if err := pnglevel.RepackWithOptions(io.Discard, bytes.NewReader(src), opts); err != errSink {
+			t.Errorf("got %v, want sink error", err)
+		}
+	}
+}
+
+func TestReadIHDRAllocs(t *testing.T) {
+	src := encodePNG(t, testImage(30, 20), png.BestSpeed)
+	r := bytes.NewReader(src)
+	h, err := pnglevel.ReadIHDR(r)
+	if err != nil || h.Width != 30 || h.Height != 20 || h.ColorType != 2 {
+		t.Fatalf("got %+v, %v", h, err)
+	}
+	if n := len(src) - r.Len(); n != 33 {
+		t.Errorf("read %d bytes, want 33", n)
+	}
+	// No buffers are allocated.
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for i := 0; i < 100; i++ {
+		r.Reset(src)
+		pnglevel.ReadIHDR(r)
+	}
+	runtime.ReadMemStats(&after)
+	if n := (after.TotalAlloc - before.TotalAlloc) / 100; n > 1024 {
+		t.Errorf("allocated %d bytes per call", n)
+	}
+}
+
+func BenchmarkReadIHDR(b *testing.B) {
+	src := largeImage(b)
+	b.Run("ReadIHDR", func(b *testing.B) {
+		b.ReportAllocs()
+		r := bytes.NewReader(src)
+		for i := 0; i < b.N; i++ {
+			r.Reset(src)
+			if _, err := pnglevel.ReadIHDR(r); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Repack", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := pnglevel.Repack(io.Discard, bytes.NewReader(src), zlib.BestSpeed); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestAppleCgBI(t *testing.T) {
+	clean := encodePNG(t, testImage(10, 10), png.BestSpeed)
+	cgbi := chunk{typ: "CgBI", data: []byte{0x50, 0x00, 0x20, 0x06}}
+	chunks := readChunks(t, clean)
+	for name, src := range map[string][]byte{
+		"before IHDR": buildPNG(append([]chunk{cgbi}, chunks...)...),
+		"after IHDR":  withChunks(t, clean, cgbi),
+	} {
+		err := pnglevel.RepackWithOptions(io.Discard, bytes.NewReader(src), pnglevel.Options{Level: 9})
+		if !errors.Is(err, pnglevel.ErrAppleCgBI) {
+			t.Errorf("%s: got %v, want ErrAppleCgBI", name, err)
+		}
+	}
+	if _, err := pnglevel.ReadIHDR(bytes.NewReader(buildPNG(append([]chunk{cgbi}, chunks...)...))); !errors.Is(err, pnglevel.ErrAppleCgBI) {
+		t.Errorf("ReadIHDR: got %v, want ErrAppleCgBI", err)
+	}
+}
+
+func TestDedup(t *testing.T) {
+	clean := encodePNG(t, testImage(20, 10), png.BestSpeed)
+	a := chunk{typ: "tEXt", data: []byte("Comment\x00same")}
+	b := chunk{typ: "tEXt", data: []byte("Comment\x00different")}
+	srgb := chunk{typ: "sRGB", data: []byte{0}}
+	src := withChunks(t, clean, srgb, srgb, a, a, b)
+	for _, tc := range []struct {
+		canonicalize bool
+		want         string
+		text         int // index of the first tEXt chunk
+	}{
+		{false, "[IHDR sRGB tEXt tEXt IDAT IEND]", 2},
+		{true, "[IHDR sRGB IDAT tEXt tEXt IEND]", 3},
+	} {
+		out := repack(t, src, pnglevel.Options{Level: 9, Dedup: true, Canonicalize: tc.canonicalize})
+		chunks := readChunks(t, out)
+		if got := fmt.Sprint(chunkTypes(chunks)); got != tc.want {
+			t.Fatalf("Canonicalize %v: got chunks %s, want %s", tc.canonicalize, got, tc.want)
+		}
+		if !bytes.Equal(chunks[tc.text].data, a.data) || !bytes.Equal(chunks[tc.text+1].data, b.data) {
+			t.Errorf("Canonicalize %v: got tEXt %q and %q", tc.canonicalize, chunks[tc.text].data, chunks[tc.text+1].data)
+		}
+		samePixels(t, clean, out)
+	}
+	if n := len(readChunks(t, repack(t, src, pnglevel.Options{Level: 9}))); n != 8 {
+		t.Errorf("got %d chunks without Dedup, want 8", n)
+	}
+}
+
+// writeCounter counts calls to Write.
+type writeCounter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *writeCounter) Write(b []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(b)
+}
+
+// flushWriter is a writer with a Flush method.
+type flushWriter struct{ writeCounter }
+
+func (w *flushWriter) Flush() error { return nil }
+
+func TestBufferedOutput(t *testing.T) {
+	// Each chunk is written separately without buffering.
+	var text []chunk
+	for i := 0; i < 1000; i++ {
+		text = append(text, chunk{typ: "tEXt", data: []byte(fmt.Sprint("Comment\x00", i))})
+	}
+	src := withChunks(t, splitIDAT(t, encodePNG(t, testImage(300, 200), png.BestSpeed), 200), text...)
+	opts := pnglevel.Options{Level: 1, IDATSize: 200}
+	p, err := pnglevel.NewReaderWithOptions(bytes.NewReader(src), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var direct writeCounter
+	if _, err := io.Copy(&direct, p); err != nil {
+		t.Fatal(err)
+	}
+	var buffered writeCounter
+	if err := pnglevel.RepackWithOptions(&buffered, bytes.NewReader(src), opts); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buffered.Bytes(), direct.Bytes()) {
+		t.Error("buffered output differs")
+	}
+	// Output fits in a few buffers of 32K.
+	if max := buffered.Len()/(32<<10) + 1; buffered.writes > max || direct.writes < 10*max {
+		t.Errorf("%d writes of %d bytes, %d without buffering", buffered.writes, buffered.Len(), direct.writes)
+	}
+	// Writers with Flush are not buffered again.
+	var fw flushWriter
+	if err := pnglevel.RepackWithOptions(&fw, bytes.NewReader(src), opts); err != nil {
+		t.Fatal(err)
+	}
+	if fw.writes != direct.writes || !bytes.Equal(fw.Bytes(), direct.Bytes()) {
+		t.Errorf("got %d writes to a writer with Flush, want %d", fw.writes, direct.writes)
+	}
+}
+
+// withTable returns the PNG file b with checksums computed using tab.
+func withTable(t *testing.T, b []byte, tab *crc32.Table) []byte {
+	t.Helper()
+	out := []byte("\x89PNG\r\n\x1a\n")
+	for _, c := range readChunks(t, b) {
+		var n [4]byte
+		binary.BigEndian.PutUint32(n[:], uint32(len(c.data)))
+		out = append(append(append(out, n[:]...), c.typ...), c.data...)
+		binary.BigEndian.PutUint32(n[:], crc32.Checksum(out[len(out)-4-len(c.data):], tab))
+		out = append(out, n[:]...)
+	}
+	return out
+}
+
+func TestCRCTable(t *testing.T) {
+	tab := crc32.MakeTable(crc32.Castagnoli)
+	clean := withChunks(t, encodePNG(t, testImage(40, 30), png.BestSpeed), chunk{typ: "zTXt", data: append([]byte("Comment\x00\x00"), zlibData(t, []byte("table"), 0)...)})
+	src := withTable(t, splitIDAT(t, clean, 300), tab)
+	for _, opts := range []pnglevel.Options{
+		{Level: 9, CRCTable: tab},
+		{Level: 9, CRCTable: tab, Filter: pnglevel.FilterMinSum, IDATSize: 100},
+	} {
+		out := repack(t, src, opts)
+		if !bytes.Equal(out, withTable(t, out, tab)) {
+			t.Errorf("%+v: checksums are not computed with the table", opts)
+		}
+		samePixels(t, clean, withTable(t, out, crc32.IEEETable))
+	}
+	if err := pnglevel.RepackWithOptions(io.Discard, bytes.NewReader(clean), pnglevel.Options{Level: 9, CRCTable: tab}); !errors.Is(err, pnglevel.ErrBadChecksum) {
+		t.Errorf("standard checksums with custom table: got %v, want ErrBadChecksum", err)
+	}
+}
+
+func TestMaxChunks(t *testing.T) {
+	clean := encodePNG(t, testImage(40, 30), png.BestSpeed)
+	empty := make([]chunk, 5000)
+	for i := range empty {
+		empty[i] = chunk{typ: "emPt"}
+	}
+	for name, tc := range map[string]struct {
+		src []byte
+		max int
+	}{
+		"empty chunks": {withChunks(t, clean, empty...), 1000},
+		"IDAT chunks":  {splitIDAT(t, clean, 1), 1000},
+	} {
+		for _, repair := range []bool{false, true} {
+			err := pnglevel.RepackWithOptions(io.Discard, bytes.NewReader(tc.src), pnglevel.Options{Level: 9, MaxChunks: tc.max, Repair: repair})
+			if !errors.Is(err, pnglevel.ErrTooManyChunks) {
+				t.Errorf("%s, Repair %v: got %v, want ErrTooManyChunks", name, repair, err)
+			}
+		}
+	}
+	samePixels(t, clean, repack(t, clean, pnglevel.Options{Level: 9, MaxChunks: len(readChunks(t, clean))}))
+}
@@ -0,0 +1,62 @@
+package pnglevel
+
+import "io"
+
+// sanitizeKeep contains types of ancillary chunks kept by Sanitize:
+// those affecting how the image is displayed, and animation.
+var sanitizeKeep = map[string]bool{
+	"acTL": true,
+	"bKGD": true,
+	"cHRM": true,
+	"cICP": true,
+	"cLLI": true,
+	"fcTL": true,
+	"fdAT": true,
+	"gAMA": true,
+	"hIST": true,
+	"iCCP": true,
+	"mDCV": true,
+	"oFFs": true,
+	"pCAL": true,
+	"pHYs": true,
+	"sBIT": true,
+	"sCAL": true,
+	"sPLT": true,
+	"sRGB": true,
+	"tRNS": true,
+}
+
+// Sanitize is like Repack, but also removes ancillary chunks that carry
+// metadata rather than affect how the image is displayed: text chunks
+// (tEXt, zTXt, iTXt), eXIf, tIME, and any unknown chunks. Color chunks,
+// such as gAMA, cHRM, sRGB, and iCCP, transparency, background, and
+// animation are kept.
+func Sanitize(w io.Writer, r io.Reader, level int) error {
+	return RepackWithOptions(w, r, Options{
+		Level:     level,
+		KeepChunk: func(chunkType string) bool { return sanitizeKeep[chunkType] },
+	})
+}
+
+// StripChunks returns a function for Options.KeepChunk that removes
+// ancillary chunks of the given types, such as "tEXt" and "tIME",
+// and keeps all others.
+func StripChunks(types ...string) func(chunkType string) bool {
+	strip := chunkSet(types)
+	return func(chunkType string) bool { return !strip[chunkType] }
+}
+
+// KeepOnlyChunks returns a function for Options.KeepChunk that keeps
+// only ancillary chunks of the given types, removing all others.
+func KeepOnlyChunks(types ...string) func(chunkType string) bool {
+	keep := chunkSet(types)
+	return func(chunkType string) bool { return keep[chunkType] }
+}
+
+func chunkSet(types []string) map[string]bool {
+	m := make(map[string]bool, len(types))
+	for _, t := range types {
+		m[t] = true
+	}
+	return m
+}
@@ -0,0 +1,103 @@
+package pnglevel
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+// ChunkInfo describes a chunk of a PNG file.
+type ChunkInfo struct {
+	Type     string
+	Length   int
+	CRCValid bool
+	Offset   int64 // position of the chunk length field in the file
+}
+
+// ListChunks reads a PNG file from r and returns information about
+// its chunks without decompressing anything. Chunks with invalid
+// checksums are reported rather than treated as errors. Reading stops
+// after IEND. If the file is malformed or truncated, ListChunks returns
+// the chunks read so far along with the error, which matches
+// ErrTruncated if the file ends before IEND.
+func ListChunks(r io.Reader) ([]ChunkInfo, error) {
+	var chunks []ChunkInfo
+	err := scan(r, func(c ChunkInfo) error {
+		chunks = append(chunks, c)
+		return nil
+	})
+	return chunks, err
+}
+
+// Scan reads a PNG file from r and calls fn for each of its chunks,
+// like ListChunks, without decompressing anything or producing output.
+// If fn returns an error, Scan stops and returns it.
+func Scan(r io.Reader, fn func(chunkType string, length int, crcOK bool) error) error {
+	return scan(r, func(c ChunkInfo) error {
+		return fn(c.Type, c.Length, c.CRCValid)
+	})
+}
+
+// scan calls fn for each chunk of the PNG file read from r.
+// End of input before IEND is reported as *Error.
+func scan(r io.Reader, fn func(ChunkInfo) error) error {
+	cr := &countReader{r: r}
+	kind := ""
+	truncated := func(err error) error {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			if err == io.EOF && kind == "" {
+				err = ErrMissingIEND
+			} else {
+				err = io.ErrUnexpectedEOF
+			}
+			return &Error{ChunkType: kind, Offset: cr.n, Err: err}
+		}
+		return err
+	}
+	r = cr
+	var tmp [8]byte
+	if _, err := io.ReadFull(r, tmp[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return truncated(err)
+	}
+	if string(tmp[:]) != pngHeader {
+		return ErrNotPNG
+	}
+	off := int64(len(pngHeader))
+	crc := crc32.NewIEEE()
+	for {
+		kind = ""
+		if _, err := io.ReadFull(r, tmp[:]); err != nil {
+			// A clean end of file between chunks is missing IEND.
+			return truncated(err)
+		}
+		length := binary.BigEndian.Uint32(tmp[:4])
+		if length > maxChunkLen {
+			return ErrChunkTooBig
+		}
+		kind = string(tmp[4:8])
+		crc.Reset()
+		crc.Write(tmp[4:8])
+		if _, err := io.CopyN(crc, r, int64(length)); err != nil {
+			return truncated(err)
+		}
+		if _, err := io.ReadFull(r, tmp[:4]); err != nil {
+			return truncated(err)
+		}
+		err := fn(ChunkInfo{
+			Type:     kind,
+			Length:   int(length),
+			CRCValid: binary.BigEndian.Uint32(tmp[:4]) == crc.Sum32(),
+			Offset:   off,
+		})
+		if err != nil {
+			return err
+		}
+		off += 12 + int64(length)
+		if kind == "IEND" {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package pnglevel
+
+import "io"
+
+// Stats describes a recompressed PNG file.
+type Stats struct {
+	OriginalIDATBytes int64 // image data read, excluding chunk headers and checksums
+	NewIDATBytes      int64 // image data written, excluding chunk headers and checksums
+	TotalIn           int64 // size of the input file
+	TotalOut          int64 // size of the output file
+	ChunkCount        int   // number of chunks read
+}
+
+// RepackWithStats is like Repack, but also returns statistics
+// about the conversion.
+func RepackWithStats(w io.Writer, r io.Reader, level int) (Stats, error) {
+	p, err := NewReaderWithOptions(r, Options{Level: level})
+	if err != nil {
+		return Stats{}, err
+	}
+	defer p.Close()
+	n, err := p.copyTo(w)
+	s := Stats{
+		OriginalIDATBytes: p.idatIn,
+		NewIDATBytes:      p.idatOut,
+		TotalIn:           p.in.n,
+		TotalOut:          n,
+		ChunkCount:        p.chunks,
+	}
+	return s, err
+}
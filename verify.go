@@ -0,0 +1,17 @@
+package pnglevel
+
+import "io"
+
+// Verify reads a PNG file from r and checks its structure without
+// producing output: the signature, IHDR, checksums of all chunks, order
+// of IDAT chunks, integrity of image data and of other compressed
+// data, such as APNG frames and ICC profiles, which is decompressed but
+// not recompressed, and the presence of IEND at the end of the file.
+// It returns the first error found, or nil if the file is valid.
+func Verify(r io.Reader) error {
+	p := newReader(r, Options{RequireIEND: true})
+	p.sink = io.Discard
+	p.verifyOnly = true
+	_, err := io.Copy(io.Discard, p)
+	return err
+}
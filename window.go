@@ -0,0 +1,69 @@
+package pnglevel
+
+import (
+	"compress/flate"
+	"encoding/binary"
+	"hash"
+	"hash/adler32"
+	"io"
+)
+
+// Strategy is a deflate strategy for compressing image data.
+type Strategy int
+
+const (
+	// StrategyDefault compresses image data as set by Level.
+	StrategyDefault Strategy = iota
+
+	// StrategyHuffmanOnly compresses image data with Huffman coding
+	// only, without matching repeated strings, regardless of Level.
+	// It is fast and sometimes better for filtered photographic images,
+	// but worse for images with large areas of flat color.
+	StrategyHuffmanOnly
+)
+
+// windowWriter writes a zlib stream whose header and checksum are
+// built here rather than by compress/zlib, for a window smaller than
+// the 32K used by compress/flate or for Huffman-only compression.
+// Since flate can't limit the distance of back-references, a smaller
+// window requires Huffman coding only, or storing data with
+// NoCompression, neither of which needs a window.
+type windowWriter struct {
+	w   io.Writer
+	fw  *flate.Writer
+	sum hash.Hash32
+}
+
+func newWindowWriter(w io.Writer, level, bits int, raw bool) (io.WriteCloser, error) {
+	if level != flate.NoCompression {
+		level = flate.HuffmanOnly
+	}
+	fw, err := flate.NewWriter(w, level)
+	if err != nil {
+		return nil, err
+	}
+	if raw {
+		return fw, nil
+	}
+	cmf := byte(bits-8)<<4 | 8
+	flg := byte((31 - uint(cmf)<<8%31) % 31)
+	if _, err := w.Write([]byte{cmf, flg}); err != nil {
+		return nil, err
+	}
+	return &windowWriter{w: w, fw: fw, sum: adler32.New()}, nil
+}
+
+func (z *windowWriter) Write(b []byte) (int, error) {
+	z.sum.Write(b)
+	return z.fw.Write(b)
+}
+
+func (z *windowWriter) Close() error {
+	if err := z.fw.Close(); err != nil {
+		return err
+	}
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], z.sum.Sum32())
+	_, err := z.w.Write(b[:])
+	return err
+}
@@ -0,0 +1,62 @@
+package pnglevel
+
+import "io"
+
+// Writer recompresses a PNG file written to it.
+type Writer struct {
+	pw   *io.PipeWriter
+	done chan error
+	err  error
+}
+
+// NewWriter returns a Writer that accepts a PNG file through Write and
+// writes it recompressed with the given level to w. Input may be split
+// into writes arbitrarily. Output is produced as input arrives, by a
+// Reader running in a separate goroutine. The caller must call Close
+// when done writing.
+func NewWriter(w io.Writer, level int) *Writer {
+	pr, pw := io.Pipe()
+	return newWriter(w, NewReader(pr, level), pr, pw)
+}
+
+// NewWriterWithOptions is like NewWriter, but configures the conversion
+// with the given options. With Options.RequireIEND, Close also reports
+// data following IEND.
+func NewWriterWithOptions(w io.Writer, opts Options) (*Writer, error) {
+	pr, pw := io.Pipe()
+	p, err := NewReaderWithOptions(pr, opts)
+	if err != nil {
+		return nil, err
+	}
+	return newWriter(w, p, pr, pw), nil
+}
+
+func newWriter(w io.Writer, p *Reader, pr *io.PipeReader, pw *io.PipeWriter) *Writer {
+	z := &Writer{pw: pw, done: make(chan error, 1)}
+	go func() {
+		_, err := io.Copy(w, p)
+		p.Close()
+		// Fail pending and future writes.
+		pr.CloseWithError(err)
+		z.done <- err
+	}()
+	return z
+}
+
+// Write writes PNG data. It returns an error if processing of the data
+// written so far has failed.
+func (z *Writer) Write(b []byte) (int, error) {
+	return z.pw.Write(b)
+}
+
+// Close marks the end of input and waits until all output is written,
+// returning the first error that occurred. Input that ends before IEND
+// is reported as an error matching ErrTruncated.
+func (z *Writer) Close() error {
+	if z.done != nil {
+		z.pw.Close()
+		z.err = <-z.done
+		z.done = nil
+	}
+	return z.err
+}